@@ -3,110 +3,328 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/mskcc/smile-dremio-gateway/internal/dremio"
+	"github.com/mskcc/smile-dremio-gateway/internal/health"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
 	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"github.com/mskcc/smile-dremio-gateway/internal/tracing"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// cmdMigrate applies the dremio schema migrations and exits instead of running the service
+const cmdMigrate = "migrate"
+
 func setupOptions() {
 	pflag.StringP("cfg_file", "f", "", "Path to configuration file")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [%s]\n\n", filepath.Base(os.Args[0]), cmdMigrate)
+		fmt.Fprintf(os.Stderr, "Without a command the gateway runs, %s creates or upgrades the dremio tables.\n\n", cmdMigrate)
+		pflag.PrintDefaults()
+	}
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 }
 
-func parseArgs() (dremio.DremioArgs, smile.SmileArgs, error) {
+func readConfig() error {
 	if viper.GetBool("help") {
-		pflag.PrintDefaults()
+		pflag.Usage()
 		os.Exit(0)
 	}
-	var DremioArgs dremio.DremioArgs
-	var SmileArgs smile.SmileArgs
 	cf := viper.GetString("cfg_file")
 	if cf == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing cfg_file argument")
+		return errors.New("Missing cfg_file argument")
 	}
 	viper.SetConfigName(filepath.Base(cf))
 	viper.SetConfigType(strings.TrimPrefix(filepath.Ext(cf), "."))
 	viper.AddConfigPath(filepath.Dir(cf))
 	if err := viper.ReadInConfig(); err != nil {
-		return DremioArgs, SmileArgs, errors.New("Cannot read cfg_file")
+		return errors.New("Cannot read cfg_file")
 	}
+	return nil
+}
+
+func parseDremioArgs() (dremio.DremioArgs, error) {
+	var DremioArgs dremio.DremioArgs
 	if DremioArgs.Host = viper.GetString("dremio.host"); DremioArgs.Host == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.host property in config file")
-	}
-	if DremioArgs.Username = viper.GetString("dremio.username"); DremioArgs.Username == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.username property in config file")
+		return DremioArgs, errors.New("Missing dremio.host property in config file")
 	}
-	if DremioArgs.Password = viper.GetString("dremio.password"); DremioArgs.Password == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.password property in config file")
+	DremioArgs.Port = viper.GetString("dremio.port")
+	switch DremioArgs.AuthMode = viper.GetString("dremio.authmode"); DremioArgs.AuthMode {
+	case "", dremio.AuthBasic:
+		if DremioArgs.Username = viper.GetString("dremio.username"); DremioArgs.Username == "" {
+			return DremioArgs, errors.New("Missing dremio.username property in config file")
+		}
+		if DremioArgs.Password = viper.GetString("dremio.password"); DremioArgs.Password == "" {
+			return DremioArgs, errors.New("Missing dremio.password property in config file")
+		}
+	case dremio.AuthToken:
+		if DremioArgs.Token = viper.GetString("dremio.token"); DremioArgs.Token == "" {
+			return DremioArgs, errors.New("Missing dremio.token property in config file")
+		}
+	case dremio.AuthTokenFile:
+		if DremioArgs.TokenPath = viper.GetString("dremio.tokenpath"); DremioArgs.TokenPath == "" {
+			return DremioArgs, errors.New("Missing dremio.tokenpath property in config file")
+		}
+		DremioArgs.TokenPath = os.ExpandEnv(DremioArgs.TokenPath)
+	default:
+		return DremioArgs, errors.New("Invalid dremio.authmode property in config file, must be one of basic, pat or tokenfile")
 	}
 	if DremioArgs.ObjectStore = viper.GetString("dremio.objectstore"); DremioArgs.ObjectStore == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.objectstore property in config file")
+		return DremioArgs, errors.New("Missing dremio.objectstore property in config file")
 	}
 	if DremioArgs.RequestTable = viper.GetString("dremio.requesttable"); DremioArgs.RequestTable == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.requesttable property in config file")
+		return DremioArgs, errors.New("Missing dremio.requesttable property in config file")
 	}
 	if DremioArgs.SampleTable = viper.GetString("dremio.sampletable"); DremioArgs.SampleTable == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing dremio.sampletable property in config file")
+		return DremioArgs, errors.New("Missing dremio.sampletable property in config file")
+	}
+	if DremioArgs.PoolSize = viper.GetInt("dremio.poolsize"); DremioArgs.PoolSize < 0 {
+		return DremioArgs, errors.New("dremio.poolsize property in config file must not be negative")
+	}
+	DremioArgs.TLS.Enabled = viper.GetBool("dremio.tls.enabled")
+	DremioArgs.TLS.CAPath = os.ExpandEnv(viper.GetString("dremio.tls.capath"))
+	DremioArgs.TLS.CertPath = os.ExpandEnv(viper.GetString("dremio.tls.certpath"))
+	DremioArgs.TLS.KeyPath = os.ExpandEnv(viper.GetString("dremio.tls.keypath"))
+	DremioArgs.TLS.ServerName = viper.GetString("dremio.tls.servername")
+	DremioArgs.TLS.SkipVerify = viper.GetBool("dremio.tls.skipverify")
+	DremioArgs.RoutingTag = viper.GetString("dremio.routingtag")
+	DremioArgs.RoutingQueue = viper.GetString("dremio.routingqueue")
+	DremioArgs.LookupQueue = viper.GetString("dremio.queues.lookup")
+	DremioArgs.InsertQueue = viper.GetString("dremio.queues.insert")
+	DremioArgs.UpdateQueue = viper.GetString("dremio.queues.update")
+	DremioArgs.DeleteQueue = viper.GetString("dremio.queues.delete")
+	DremioArgs.Headers = viper.GetStringMapString("dremio.headers")
+	if DremioArgs.StatementTimeout = viper.GetDuration("dremio.statementtimeout"); DremioArgs.StatementTimeout < 0 {
+		return DremioArgs, errors.New("dremio.statementtimeout property in config file must not be negative")
+	}
+	DremioArgs.MaxRetries = viper.GetInt("dremio.maxretries")
+	DremioArgs.RetryBackoff = viper.GetDuration("dremio.retrybackoff")
+	DremioArgs.MaxRetryBackoff = viper.GetDuration("dremio.maxretrybackoff")
+	switch DremioArgs.AddStrategy = viper.GetString("dremio.addstrategy"); DremioArgs.AddStrategy {
+	case "", dremio.AddReplace, dremio.AddMerge:
+	default:
+		return DremioArgs, errors.New("Invalid dremio.addstrategy property in config file, must be one of replace or merge")
+	}
+	DremioArgs.JournalDir = os.ExpandEnv(viper.GetString("dremio.journaldir"))
+	if DremioArgs.InsertBatchRows = viper.GetInt("dremio.insertbatchrows"); DremioArgs.InsertBatchRows < 0 {
+		return DremioArgs, errors.New("dremio.insertbatchrows property in config file must not be negative")
+	}
+	if DremioArgs.InsertBatchBytes = viper.GetInt("dremio.insertbatchbytes"); DremioArgs.InsertBatchBytes < 0 {
+		return DremioArgs, errors.New("dremio.insertbatchbytes property in config file must not be negative")
+	}
+	if viper.IsSet("dremio.samplecolumns") {
+		// an empty list disables the columns rather than falling back to the default ones
+		DremioArgs.SampleColumns = []dremio.SampleColumn{}
+		if err := viper.UnmarshalKey("dremio.samplecolumns", &DremioArgs.SampleColumns); err != nil {
+			return DremioArgs, errors.New("Invalid dremio.samplecolumns property in config file, must be a list of column and field pairs")
+		}
 	}
+	DremioArgs.BackfillSampleColumns = viper.GetBool("dremio.backfillsamplecolumns")
+	DremioArgs.LibraryTable = viper.GetString("dremio.librarytable")
+	DremioArgs.RunTable = viper.GetString("dremio.runtable")
+	DremioArgs.FastqTable = viper.GetString("dremio.fastqtable")
+	DremioArgs.SampleAliasTable = viper.GetString("dremio.samplealiastable")
+	DremioArgs.QcReportTable = viper.GetString("dremio.qcreporttable")
+	DremioArgs.SampleAliasView = viper.GetString("dremio.samplealiasview")
+	DremioArgs.QcReportView = viper.GetString("dremio.qcreportview")
+	DremioArgs.PatientTable = viper.GetString("dremio.patienttable")
+	DremioArgs.PatientAliasTable = viper.GetString("dremio.patientaliastable")
+	DremioArgs.MigrationTable = viper.GetString("dremio.migrationtable")
+	DremioArgs.CreateFolder = viper.GetBool("dremio.createfolder")
+	return DremioArgs, nil
+}
 
+func parseSmileArgs() (smile.SmileArgs, error) {
+	var SmileArgs smile.SmileArgs
 	if SmileArgs.URL = viper.GetString("smile.url"); SmileArgs.URL == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.url property in config file")
+		return SmileArgs, errors.New("Missing smile.url property in config file")
 	}
 	if SmileArgs.CertPath = viper.GetString("smile.certpath"); SmileArgs.CertPath == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.certpath property in config file")
+		return SmileArgs, errors.New("Missing smile.certpath property in config file")
 	}
 	SmileArgs.CertPath = os.ExpandEnv(SmileArgs.CertPath)
 	if SmileArgs.KeyPath = viper.GetString("smile.keypath"); SmileArgs.KeyPath == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.keypath property in config file")
+		return SmileArgs, errors.New("Missing smile.keypath property in config file")
 	}
 	SmileArgs.KeyPath = os.ExpandEnv(SmileArgs.KeyPath)
 	if SmileArgs.Consumer = viper.GetString("smile.consumer"); SmileArgs.Consumer == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.consumer property in config file")
+		return SmileArgs, errors.New("Missing smile.consumer property in config file")
 	}
 	if SmileArgs.Password = viper.GetString("smile.password"); SmileArgs.Password == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.password property in config file")
+		return SmileArgs, errors.New("Missing smile.password property in config file")
 	}
 	if SmileArgs.Subject = viper.GetString("smile.subject"); SmileArgs.Subject == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.subject property in config file")
+		return SmileArgs, errors.New("Missing smile.subject property in config file")
 	}
 	if SmileArgs.NewRequestFilter = viper.GetString("smile.newrequestfilter"); SmileArgs.NewRequestFilter == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.newrequestfilter property in config file")
+		return SmileArgs, errors.New("Missing smile.newrequestfilter property in config file")
 	}
 	if SmileArgs.UpdateRequestFilter = viper.GetString("smile.updaterequestfilter"); SmileArgs.UpdateRequestFilter == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.updaterequestfilter property in config file")
+		return SmileArgs, errors.New("Missing smile.updaterequestfilter property in config file")
 	}
 	if SmileArgs.UpdateSampleFilter = viper.GetString("smile.updatesamplefilter"); SmileArgs.UpdateSampleFilter == "" {
-		return DremioArgs, SmileArgs, errors.New("Missing smile.updatesamplefilter property in config file")
+		return SmileArgs, errors.New("Missing smile.updatesamplefilter property in config file")
+	}
+	SmileArgs.NakDelay = viper.GetDuration("smile.nakdelay")
+	SmileArgs.DeadLetterSubject = viper.GetString("smile.deadlettersubject")
+	if SmileArgs.DeadLetterSubject != "" && smile.SubjectMatches(SmileArgs.Subject, SmileArgs.DeadLetterSubject) {
+		// the gateway would consume its own dead letters and ack them
+		return SmileArgs, errors.New("smile.deadlettersubject property in config file must not match smile.subject")
+	}
+	if SmileArgs.MaxAckPending = viper.GetInt("smile.maxackpending"); SmileArgs.MaxAckPending < 0 {
+		return SmileArgs, errors.New("smile.maxackpending property in config file must not be negative")
+	}
+	SmileArgs.Workers.AddRequestWorkers = viper.GetInt("smile.workers.addrequests")
+	SmileArgs.Workers.AddRequestQueueSize = viper.GetInt("smile.workers.addrequestqueue")
+	SmileArgs.Workers.UpdateRequestWorkers = viper.GetInt("smile.workers.updaterequests")
+	SmileArgs.Workers.UpdateRequestQueueSize = viper.GetInt("smile.workers.updaterequestqueue")
+	SmileArgs.Workers.SampleWorkers = viper.GetInt("smile.workers.samples")
+	SmileArgs.Workers.SampleQueueSize = viper.GetInt("smile.workers.samplequeue")
+	if SmileArgs.Workers.ShutdownGracePeriod = viper.GetDuration("smile.shutdowngraceperiod"); SmileArgs.Workers.ShutdownGracePeriod < 0 {
+		return SmileArgs, errors.New("smile.shutdowngraceperiod property in config file must not be negative")
 	}
 
-	return DremioArgs, SmileArgs, nil
+	return SmileArgs, nil
 }
 
 func setupSignalListener(cancel context.CancelFunc) {
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		// block until signal is received
 		s := <-c
-		log.Printf("Got signal: %s, canceling context...\n", s)
+		slog.Info("Got signal, canceling context...", "signal", s.String())
 		cancel()
 	}()
 }
 
+// parseHealthArgs reads the optional health server settings, the server is disabled when health.address is empty
+func parseHealthArgs() (health.HealthArgs, error) {
+	var HealthArgs health.HealthArgs
+	HealthArgs.Addr = viper.GetString("health.address")
+	if HealthArgs.CheckTimeout = viper.GetDuration("health.checktimeout"); HealthArgs.CheckTimeout < 0 {
+		return HealthArgs, errors.New("health.checktimeout property in config file must not be negative")
+	}
+	return HealthArgs, nil
+}
+
+// parseLogArgs reads the log level and format
+func parseLogArgs() logging.LogArgs {
+	return logging.LogArgs{
+		Level:  viper.GetString("log.level"),
+		Format: viper.GetString("log.format"),
+	}
+}
+
+// parseTracingArgs reads the tracing exporter settings, tracing is disabled unless tracing.exporter is set
+func parseTracingArgs() tracing.TracingArgs {
+	return tracing.TracingArgs{
+		Exporter:    viper.GetString("tracing.exporter"),
+		Endpoint:    viper.GetString("tracing.endpoint"),
+		Insecure:    viper.GetBool("tracing.insecure"),
+		SampleRatio: viper.GetFloat64("tracing.sampleratio"),
+		ServiceName: viper.GetString("tracing.servicename"),
+	}
+}
+
+// fatal logs msg and err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// backoff between the startup checks while dremio is unavailable
+const (
+	startupBackoff    = time.Second
+	maxStartupBackoff = 30 * time.Second
+)
+
+// untilAvailable calls fn until it succeeds or fails permanently, waiting out transient errors
+// such as dremio being unreachable, so the gateway can start before dremio is up. it gives up
+// with the last error once ctx is done.
+func untilAvailable(ctx context.Context, step string, fn func(context.Context) error) error {
+	backoff := startupBackoff
+	for {
+		err := fn(ctx)
+		if err == nil || !dremio.IsTransient(err) {
+			return err
+		}
+		slog.Warn("Dremio is not available, retrying", "step", step, "backoff", backoff, "error", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// migrate applies the pending schema migrations to dremio
+func migrate(DremioArgs dremio.DremioArgs) {
+	ctx, cancel := context.WithCancel(context.Background())
+	setupSignalListener(cancel)
+	dRepo, err := dremio.NewDremioRepos(DremioArgs)
+	if err != nil {
+		fatal("failed to create repos", err)
+	}
+	err = dRepo.Migrate(ctx)
+	dRepo.Close()
+	if err != nil {
+		fatal("failed to migrate", err)
+	}
+	slog.Info("Schema is up to date")
+}
+
 func main() {
 	setupOptions()
-	DremioArgs, SmileArgs, err := parseArgs()
+	if err := readConfig(); err != nil {
+		fatal("failed to parse arguments", err)
+	}
+	if err := logging.Setup(parseLogArgs()); err != nil {
+		fatal("failed to parse arguments", err)
+	}
+	DremioArgs, err := parseDremioArgs()
 	if err != nil {
-		log.Fatal("failed to parse arguments: ", err)
+		fatal("failed to parse arguments", err)
+	}
+	if pflag.NArg() > 1 {
+		fatal("failed to parse arguments", errors.New("too many arguments"))
+	}
+	switch cmd := pflag.Arg(0); cmd {
+	case "":
+	case cmdMigrate:
+		migrate(DremioArgs)
+		return
+	default:
+		fatal("failed to parse arguments", fmt.Errorf("unknown command: %s", cmd))
+	}
+	SmileArgs, err := parseSmileArgs()
+	if err != nil {
+		fatal("failed to parse arguments", err)
+	}
+	HealthArgs, err := parseHealthArgs()
+	if err != nil {
+		fatal("failed to parse arguments", err)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), parseTracingArgs())
+	if err != nil {
+		fatal("failed to set up tracing", err)
 	}
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -114,21 +332,62 @@ func main() {
 
 	smileAdaptor, err := smile.NewSmileAdaptor(SmileArgs)
 	if err != nil {
-		log.Fatal("failed to create a smileAdaptor: ", err)
+		fatal("failed to create a smileAdaptor", err)
 	}
 
 	dRepo, err := dremio.NewDremioRepos(DremioArgs)
 	if err != nil {
-		log.Fatal("failed to create repos: ", err)
+		fatal("failed to create repos", err)
 	}
 
-	svc, err := smile.NewService(smileAdaptor, dRepo)
+	svc, err := smile.NewService(smileAdaptor, dRepo, SmileArgs.Workers)
 	if err != nil {
-		log.Fatal("failed to create a service: ", err)
+		fatal("failed to create a service", err)
 	}
 
-	if err := svc.Run(ctx); err != nil {
-		os.Exit(1)
+	// the health server outlives ctx so it reports not ready while the service drains. it is
+	// started first, so it reports not ready while the gateway waits for dremio as well
+	healthCtx, stopHealth := context.WithCancel(context.Background())
+	var started atomic.Bool
+	if HealthArgs.Addr != "" {
+		healthSrv, err := health.NewServer(HealthArgs, func() interface{} { return svc.Status() },
+			health.Check{Name: "startup", Fn: func(context.Context) error {
+				if !started.Load() {
+					return errors.New("checking the schema and recovering interrupted requests")
+				}
+				return nil
+			}},
+			health.Check{Name: "nats", Fn: smileAdaptor.Ready},
+			health.Check{Name: "dremio", Fn: dRepo.Ping})
+		if err != nil {
+			fatal("failed to create a health server", err)
+		}
+		go func() {
+			if err := healthSrv.Run(healthCtx); err != nil {
+				slog.Error("Health server failed", "error", err)
+			}
+		}()
+	}
+
+	// only a permanent error, such as an outdated schema or an unreadable journal, stops the gateway
+	if err := untilAvailable(ctx, "check schema", dRepo.CheckSchema); err != nil && ctx.Err() == nil {
+		fatal("dremio schema is not up to date", err)
+	}
+	if err := untilAvailable(ctx, "recover", dRepo.Recover); err != nil && ctx.Err() == nil {
+		fatal("failed to recover interrupted requests", err)
+	}
+	started.Store(true)
+
+	if ctx.Err() == nil {
+		err = svc.Run(ctx)
+	}
+	stopHealth()
+	// flush the spans of the last messages
+	if err := shutdownTracing(context.Background()); err != nil {
+		slog.Error("Could not flush traces", "error", err)
+	}
+	if err != nil {
+		fatal("service failed", err)
 	}
-	log.Println("Exiting...")
+	slog.Info("Exiting...")
 }
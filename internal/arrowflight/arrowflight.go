@@ -3,58 +3,232 @@ package arrowflight
 import (
 	"context"
 	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/arrow/array"
 	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"net"
+	"time"
 )
 
 const (
-	dremioFlightPort = "32010"
+	dremioFlightPort    = "32010"
+	defaultRoutingTag   = "test-routing-tag"
+	defaultRoutingQueue = "Low Cost User Queries"
 )
 
+// Operation identifies the kind of statement being run so it can be routed to its own dremio queue
+type Operation string
+
+const (
+	OpLookup Operation = "lookup"
+	OpInsert Operation = "insert"
+	OpUpdate Operation = "update"
+	OpDelete Operation = "delete"
+)
+
+type ArrowFlightArgs struct {
+	Host string
+	Port string
+	Auth Authenticator
+	TLS  TLSArgs
+	// dremio workload management routing, empty values fall back to the defaults above
+	RoutingTag   string
+	RoutingQueue string
+	// per operation routing queue, operations without an entry use RoutingQueue
+	Queues map[Operation]string
+	// additional grpc headers sent with every call
+	Headers map[string]string
+}
+
 type ArrowFlight struct {
-	FC  flight.Client
-	ctx context.Context
+	FC   flight.Client
+	md   metadata.MD
+	args ArrowFlightArgs
+	// when md was last authenticated
+	authTime time.Time
 }
 
-func NewArrowFlight(host, id, pw string) (*ArrowFlight, error) {
-	if host == "" {
+func NewArrowFlight(ctx context.Context, args ArrowFlightArgs) (*ArrowFlight, error) {
+	if args.Host == "" {
 		return nil, errors.New("host must not be empty")
 	}
+	if args.Auth == nil {
+		return nil, errors.New("auth must not be nil")
+	}
+	if args.Port == "" {
+		args.Port = dremioFlightPort
+	}
+	if args.RoutingTag == "" {
+		args.RoutingTag = defaultRoutingTag
+	}
+	if args.RoutingQueue == "" {
+		args.RoutingQueue = defaultRoutingQueue
+	}
 	opts := make([]grpc.DialOption, 0)
-	opts = append(opts, grpc.WithInsecure())
-	fc, err := flight.NewClientWithMiddleware(net.JoinHostPort(host, dremioFlightPort), nil, nil, opts...)
+	tlsOpt, err := args.TLS.dialOption()
 	if err != nil {
 		return nil, err
 	}
-	ctx := metadata.NewOutgoingContext(context.TODO(),
-		metadata.Pairs("routing-tag", "test-routing-tag", "routing-queue", "Low Cost User Queries"))
-	if ctx, err = fc.AuthenticateBasicToken(ctx, id, pw); err != nil {
+	opts = append(opts, tlsOpt)
+	fc, err := flight.NewClientWithMiddleware(net.JoinHostPort(args.Host, args.Port), nil, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	af := &ArrowFlight{FC: fc, args: args}
+	if err := af.authenticate(ctx); err != nil {
+		fc.Close()
 		return nil, err
 	}
+	return af, nil
+}
+
+// authenticate stores the routing headers and credentials used by all calls in af.md
+func (af *ArrowFlight) authenticate(ctx context.Context) error {
+	md := metadata.New(af.args.Headers)
+	md.Set("routing-tag", af.args.RoutingTag)
+	md.Set("routing-queue", af.args.RoutingQueue)
+	now := time.Now()
+	ctx, err := af.args.Auth.Authenticate(metadata.NewOutgoingContext(ctx, md), af.FC)
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			connectionFailures.Inc()
+		} else {
+			authFailures.Inc()
+		}
+		logging.FromContext(ctx).Warn("Could not authenticate with dremio", "host", af.args.Host, "error", err)
+		return err
+	}
+	logging.FromContext(ctx).Debug("Authenticated with dremio", "host", af.args.Host)
+	af.md, _ = metadata.FromOutgoingContext(ctx)
+	af.authTime = now
+	return nil
+}
 
-	return &ArrowFlight{FC: fc, ctx: ctx}, nil
+// callContext returns ctx carrying af.md, with the routing queue replaced by the one configured for op
+func (af *ArrowFlight) callContext(ctx context.Context, op Operation) context.Context {
+	md := af.md
+	if q, ok := af.args.Queues[op]; ok && q != "" {
+		md = md.Copy()
+		md.Set("routing-queue", q)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
 }
 
-func (af *ArrowFlight) Query(query string) (*flight.Reader, error) {
+// RecordFunc is called with every record of a query result. The record is released
+// once RecordFunc returns, call Retain on it to keep it around longer.
+type RecordFunc func(rec array.Record) error
+
+// Query runs query and calls fn with every record of every endpoint of its result, one endpoint after the other
+func (af *ArrowFlight) Query(ctx context.Context, op Operation, query string, fn RecordFunc) error {
+	info, err := af.flightInfo(ctx, op, query)
+	if err != nil {
+		return err
+	}
+	for _, ep := range info.Endpoint {
+		if err := af.readEndpoint(ctx, op, ep, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exec runs a dml statement, drains and releases its result and returns the number of
+// affected rows dremio reports in the Records column
+func (af *ArrowFlight) Exec(ctx context.Context, op Operation, stmt string) (int64, error) {
+	var n int64
+	err := af.Query(ctx, op, stmt, func(rec array.Record) error {
+		for j := 0; j < int(rec.NumCols()); j++ {
+			if rec.ColumnName(j) != "Records" {
+				continue
+			}
+			col, ok := rec.Column(j).(*array.Int64)
+			if !ok {
+				return fmt.Errorf("unexpected type for Records column: %s", rec.Column(j).DataType())
+			}
+			for i := 0; i < col.Len(); i++ {
+				n += col.Value(i)
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (af *ArrowFlight) flightInfo(ctx context.Context, op Operation, query string) (info *flight.FlightInfo, err error) {
+	ctx, span := startCallSpan(ctx, "GetFlightInfo", op)
+	defer func() { endCallSpan(span, err) }()
 	desc := &flight.FlightDescriptor{
 		Type: flight.FlightDescriptor_CMD,
 		Cmd:  []byte(query),
 	}
 
-	info, err := af.FC.GetFlightInfo(af.ctx, desc)
-	if err != nil {
-		return nil, err
+	if af.args.Auth.Changed(af.authTime) {
+		if err := af.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	info, err = af.FC.GetFlightInfo(af.callContext(ctx, op), desc)
+	if status.Code(err) == codes.Unauthenticated {
+		// token has most likely expired, get a new one and try again
+		logging.FromContext(ctx).Info("Dremio rejected token, authenticating again", "host", af.args.Host)
+		if err = af.authenticate(ctx); err != nil {
+			return nil, err
+		}
+		info, err = af.FC.GetFlightInfo(af.callContext(ctx, op), desc)
+	}
+	if status.Code(err) == codes.Unavailable {
+		connectionFailures.Inc()
+	}
+	return info, err
+}
+
+// readEndpoint streams the records of a single endpoint to fn. dremio serves every endpoint
+// from the node we are connected to, so endpoint locations are not followed.
+func (af *ArrowFlight) readEndpoint(ctx context.Context, op Operation, ep *flight.FlightEndpoint, fn RecordFunc) (err error) {
+	ctx, span := startCallSpan(ctx, "DoGet", op)
+	defer func() { endCallSpan(span, err) }()
+	// cancel the stream if we stop reading early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rdr, err := af.openEndpoint(ctx, op, ep)
+	if grpcCode(err) == codes.Unauthenticated {
+		// the token may have expired since GetFlightInfo, nothing has been read yet so try again
+		logging.FromContext(ctx).Info("Dremio rejected token, authenticating again", "host", af.args.Host)
+		if err = af.authenticate(ctx); err != nil {
+			return err
+		}
+		rdr, err = af.openEndpoint(ctx, op, ep)
 	}
-	stream, err := af.FC.DoGet(af.ctx, info.Endpoint[0].Ticket)
 	if err != nil {
-		return nil, err
+		if grpcCode(err) == codes.Unavailable {
+			connectionFailures.Inc()
+		}
+		return err
 	}
+	defer rdr.Release()
+	for rdr.Next() {
+		if err := fn(rdr.Record()); err != nil {
+			return err
+		}
+	}
+	return rdr.Err()
+}
 
-	rdr, err := flight.NewRecordReader(stream)
+// openEndpoint starts the stream of an endpoint and reads its schema. a rejected token is
+// reported by the first read rather than by DoGet, so both are done here.
+func (af *ArrowFlight) openEndpoint(ctx context.Context, op Operation, ep *flight.FlightEndpoint) (*flight.Reader, error) {
+	stream, err := af.FC.DoGet(af.callContext(ctx, op), ep.Ticket)
 	if err != nil {
 		return nil, err
 	}
-	return rdr, nil
+	return flight.NewRecordReader(stream)
+}
+
+func (af *ArrowFlight) Close() error {
+	return af.FC.Close()
 }
@@ -0,0 +1,686 @@
+package arrowflight
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "smile"
+	testPassword = "secret"
+	testToken    = "token"
+	// slowQuery never completes, the test server blocks until the client gives up
+	slowQuery = "select sleep"
+	// multiEndpointQuery is served from three endpoints returning 1, 2 and 3 records
+	multiEndpointQuery = "select multi"
+	// expiringQuery expires the token between GetFlightInfo and DoGet
+	expiringQuery = "select expire"
+)
+
+// testServer counts handshakes and records the headers of every GetFlightInfo call
+type testServer struct {
+	mu         sync.Mutex
+	handshakes int
+	headers    []metadata.MD
+	// token handed out by the next handshake, changing it expires all previous tokens
+	token string
+}
+
+func (s *testServer) Validate(username, password string) (string, error) {
+	if username != testUser || password != testPassword {
+		return "", errors.New("invalid credentials")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshakes++
+	return s.token, nil
+}
+
+func (s *testServer) IsValid(bearerToken string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bearerToken != s.token {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return testUser, nil
+}
+
+// expireToken invalidates all tokens handed out so far and returns the new valid token
+func (s *testServer) expireToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token += "x"
+	return s.token
+}
+
+func (s *testServer) handshakeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handshakes
+}
+
+// startTestServer serves a single "Records" row for every query
+func startTestServer(t *testing.T, opts ...grpc.ServerOption) (*testServer, ArrowFlightArgs) {
+	t.Helper()
+	ts := &testServer{token: testToken}
+	srv := flight.NewServerWithMiddleware(nil, []flight.ServerMiddleware{flight.CreateServerBasicAuthMiddleware(ts)}, opts...)
+	srv.RegisterFlightService(&flight.FlightServiceService{
+		GetFlightInfo: func(ctx context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			ts.mu.Lock()
+			ts.headers = append(ts.headers, md)
+			ts.mu.Unlock()
+			if string(desc.Cmd) == slowQuery {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			if string(desc.Cmd) == expiringQuery {
+				ts.expireToken()
+			}
+			info := &flight.FlightInfo{FlightDescriptor: desc}
+			n := 1
+			if string(desc.Cmd) == multiEndpointQuery {
+				n = 3
+			}
+			for i := 1; i <= n; i++ {
+				info.Endpoint = append(info.Endpoint, &flight.FlightEndpoint{Ticket: &flight.Ticket{Ticket: []byte(strconv.Itoa(i))}})
+			}
+			return info, nil
+		},
+		DoGet: func(tkt *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+			// every endpoint returns its ticket number as its Records count
+			n, err := strconv.ParseInt(string(tkt.Ticket), 10, 64)
+			if err != nil {
+				return err
+			}
+			schema := arrow.NewSchema([]arrow.Field{{Name: "Records", Type: arrow.PrimitiveTypes.Int64}}, nil)
+			b := array.NewInt64Builder(memory.DefaultAllocator)
+			defer b.Release()
+			b.Append(n)
+			col := b.NewArray()
+			defer col.Release()
+			rec := array.NewRecord(schema, []array.Interface{col}, 1)
+			defer rec.Release()
+			w := flight.NewRecordWriter(stream, ipc.WithSchema(schema))
+			defer w.Close()
+			return w.Write(rec)
+		},
+	})
+	if err := srv.Init("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(srv.Shutdown)
+	host, port, _ := net.SplitHostPort(srv.Addr().String())
+	return ts, ArrowFlightArgs{Host: host, Port: port, Auth: BasicAuth(testUser, testPassword)}
+}
+
+type testPKI struct {
+	caPath, serverCert, serverKey, clientCert, clientKey string
+	caPool                                               *x509.CertPool
+}
+
+// newTestPKI writes a ca, a server certificate for 127.0.0.1/localhost and a client certificate to a temp dir
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := testPKI{caPath: filepath.Join(dir, "ca.pem"), caPool: x509.NewCertPool()}
+	pki.caPool.AddCert(caCert)
+	writePEM(t, pki.caPath, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost", "dremio.test"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certPath, "CERTIFICATE", der)
+		writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+		return certPath, keyPath
+	}
+	pki.serverCert, pki.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	pki.clientCert, pki.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serverCreds(t *testing.T, pki testPKI, requireClientCert bool) grpc.ServerOption {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(pki.serverCert, pki.serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if requireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = pki.caPool
+	}
+	return grpc.Creds(credentials.NewTLS(cfg))
+}
+
+func queryRecords(t *testing.T, af *ArrowFlight) {
+	t.Helper()
+	n, err := af.Exec(context.Background(), OpLookup, "select 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Records = %d, want 1", n)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	_, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	queryRecords(t, af)
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	_, args := startTestServer(t, serverCreds(t, pki, false))
+
+	tests := []struct {
+		name    string
+		tls     TLSArgs
+		wantErr bool
+	}{
+		{"ca bundle", TLSArgs{Enabled: true, CAPath: pki.caPath}, false},
+		{"server name override", TLSArgs{Enabled: true, CAPath: pki.caPath, ServerName: "dremio.test"}, false},
+		{"wrong server name", TLSArgs{Enabled: true, CAPath: pki.caPath, ServerName: "other.test"}, true},
+		{"unknown ca", TLSArgs{Enabled: true}, true},
+		{"skip verify", TLSArgs{Enabled: true, SkipVerify: true}, false},
+		{"plaintext to tls server", TLSArgs{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args.TLS = tt.tls
+			af, err := NewArrowFlight(context.Background(), args)
+			if tt.wantErr {
+				if err == nil {
+					af.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer af.Close()
+			queryRecords(t, af)
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	_, args := startTestServer(t, serverCreds(t, pki, true))
+
+	args.TLS = TLSArgs{Enabled: true, CAPath: pki.caPath}
+	if af, err := NewArrowFlight(context.Background(), args); err == nil {
+		af.Close()
+		t.Fatal("expected error without client certificate")
+	}
+
+	args.TLS.CertPath, args.TLS.KeyPath = pki.clientCert, pki.clientKey
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	queryRecords(t, af)
+}
+
+func TestTLSArgsErrors(t *testing.T) {
+	pki := newTestPKI(t)
+	notPEM := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tls  TLSArgs
+	}{
+		{"missing ca", TLSArgs{Enabled: true, CAPath: "/does/not/exist.pem"}},
+		{"empty ca", TLSArgs{Enabled: true, CAPath: notPEM}},
+		{"cert without key", TLSArgs{Enabled: true, CertPath: pki.clientCert}},
+		{"key without cert", TLSArgs{Enabled: true, KeyPath: pki.clientKey}},
+		{"mismatched pair", TLSArgs{Enabled: true, CertPath: pki.clientCert, KeyPath: pki.serverKey}},
+	}
+	for _, tt := range tests {
+		if _, err := tt.tls.dialOption(); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestRoutingHeaders(t *testing.T) {
+	ts, args := startTestServer(t)
+	args.RoutingTag = "ingest"
+	args.RoutingQueue = "Default Queue"
+	args.Queues = map[Operation]string{OpInsert: "Ingest Queue", OpDelete: ""}
+	args.Headers = map[string]string{"X-Cluster": "smile"}
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	for _, op := range []Operation{OpLookup, OpInsert, OpDelete} {
+		if _, err := af.Exec(context.Background(), op, "select 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantQueues := []string{"Default Queue", "Ingest Queue", "Default Queue"}
+	if len(ts.headers) != len(wantQueues) {
+		t.Fatalf("got %d calls, want %d", len(ts.headers), len(wantQueues))
+	}
+	for i, md := range ts.headers {
+		if got := md.Get("routing-queue"); len(got) != 1 || got[0] != wantQueues[i] {
+			t.Errorf("call %d: routing-queue = %v, want %s", i, got, wantQueues[i])
+		}
+		if got := md.Get("routing-tag"); len(got) != 1 || got[0] != "ingest" {
+			t.Errorf("call %d: routing-tag = %v, want ingest", i, got)
+		}
+		if got := md.Get("x-cluster"); len(got) != 1 || got[0] != "smile" {
+			t.Errorf("call %d: x-cluster = %v, want smile", i, got)
+		}
+	}
+}
+
+func TestDefaultRoutingHeaders(t *testing.T) {
+	ts, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	queryRecords(t, af)
+	md := ts.headers[0]
+	if got := md.Get("routing-tag"); len(got) != 1 || got[0] != defaultRoutingTag {
+		t.Errorf("routing-tag = %v, want %s", got, defaultRoutingTag)
+	}
+	if got := md.Get("routing-queue"); len(got) != 1 || got[0] != defaultRoutingQueue {
+		t.Errorf("routing-queue = %v, want %s", got, defaultRoutingQueue)
+	}
+}
+
+func TestPoolReusesClients(t *testing.T) {
+	ts, args := startTestServer(t)
+	p, err := NewPool(args, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		af, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		queryRecords(t, af)
+		p.Put(af)
+	}
+	if got := ts.handshakeCount(); got != 1 {
+		t.Errorf("handshakes = %d, want 1", got)
+	}
+}
+
+func TestPoolLimitsClients(t *testing.T) {
+	_, args := startTestServer(t)
+	p, err := NewPool(args, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	af, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Get on exhausted pool returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	p.Put(af)
+	af, err = p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(af)
+}
+
+func TestPoolReauthenticates(t *testing.T) {
+	ts, args := startTestServer(t)
+	p, err := NewPool(args, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	af, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queryRecords(t, af)
+	ts.expireToken()
+	queryRecords(t, af)
+	p.Put(af)
+	if got := ts.handshakeCount(); got != 2 {
+		t.Errorf("handshakes = %d, want 2", got)
+	}
+}
+
+func TestQueryReauthenticatesForEndpoint(t *testing.T) {
+	ts, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	n, err := af.Exec(context.Background(), OpLookup, expiringQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("got %d records, want 1", n)
+	}
+	if got := ts.handshakeCount(); got != 2 {
+		t.Errorf("handshakes = %d, want 2", got)
+	}
+}
+
+func TestPoolRelease(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantHandshakes int
+	}{
+		{"success", nil, 1},
+		{"statement rejected", status.Error(codes.InvalidArgument, "syntax error"), 1},
+		{"unavailable", fmt.Errorf("wrapped: %w", status.Error(codes.Unavailable, "connection reset")), 2},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "bad token"), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, args := startTestServer(t)
+			p, err := NewPool(args, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			af, err := p.Get(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Release(af, tt.err)
+			// a discarded client frees its slot, the next one authenticates anew
+			af, err = p.Get(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			queryRecords(t, af)
+			p.Put(af)
+			if got := ts.handshakeCount(); got != tt.wantHandshakes {
+				t.Errorf("handshakes = %d, want %d", got, tt.wantHandshakes)
+			}
+		})
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	_, args := startTestServer(t)
+	p, err := NewPool(args, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Get(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("Get on closed pool returned %v, want %v", err, ErrPoolClosed)
+	}
+}
+
+func TestBasicAuthBadCredentials(t *testing.T) {
+	_, args := startTestServer(t)
+	args.Auth = BasicAuth(testUser, "wrong")
+	before := testutil.ToFloat64(authFailures)
+	if af, err := NewArrowFlight(context.Background(), args); err == nil {
+		af.Close()
+		t.Fatal("expected error")
+	}
+	if got := testutil.ToFloat64(authFailures) - before; got != 1 {
+		t.Errorf("auth failures increased by %v, want 1", got)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	ts, args := startTestServer(t)
+	args.Auth = TokenAuth(testToken)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	queryRecords(t, af)
+	if got := ts.handshakeCount(); got != 0 {
+		t.Errorf("handshakes = %d, want 0", got)
+	}
+
+	args.Auth = TokenAuth("revoked")
+	bad, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	if _, err := bad.Exec(context.Background(), OpLookup, "select 1"); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Query with bad token returned %v, want Unauthenticated", err)
+	}
+}
+
+func TestTokenFileAuth(t *testing.T) {
+	ts, args := startTestServer(t)
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args.Auth = TokenFileAuth(path)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	queryRecords(t, af)
+
+	// rotate the token on the server and on disk, the client should pick up the new file
+	rotated := ts.expireToken()
+	if err := os.WriteFile(path, []byte(rotated), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	queryRecords(t, af)
+}
+
+func TestTokenFileAuthErrors(t *testing.T) {
+	_, args := startTestServer(t)
+	empty := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(empty, []byte("  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{empty, "/does/not/exist"} {
+		args.Auth = TokenFileAuth(path)
+		if af, err := NewArrowFlight(context.Background(), args); err == nil {
+			af.Close()
+			t.Errorf("%s: expected error", path)
+		}
+	}
+}
+
+func TestQueryDeadline(t *testing.T) {
+	_, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := af.Exec(ctx, OpLookup, slowQuery); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Query returned %v, want DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := af.Exec(ctx, OpLookup, slowQuery); status.Code(err) != codes.Canceled {
+		t.Fatalf("Query returned %v, want Canceled", err)
+	}
+	// the client is still usable afterwards
+	queryRecords(t, af)
+}
+
+func TestQueryAllEndpoints(t *testing.T) {
+	_, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	var got []int
+	err = af.Query(context.Background(), OpLookup, multiEndpointQuery, func(rec array.Record) error {
+		got = append(got, int(rec.Column(0).(*array.Int64).Value(0)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// endpoints are read one after the other
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("got records %v, want [1 2 3]", got)
+	}
+}
+
+func TestQueryStopsOnError(t *testing.T) {
+	_, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	stop := errors.New("stop")
+	calls := 0
+	err = af.Query(context.Background(), OpLookup, multiEndpointQuery, func(rec array.Record) error {
+		calls++
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("Query returned %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("RecordFunc called %d times, want 1", calls)
+	}
+}
+
+func TestExecSumsAllEndpoints(t *testing.T) {
+	_, args := startTestServer(t)
+	af, err := NewArrowFlight(context.Background(), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+
+	n, err := af.Exec(context.Background(), OpUpdate, multiEndpointQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Fatalf("Exec = %d, want 6", n)
+	}
+}
@@ -0,0 +1,114 @@
+package arrowflight
+
+import (
+	"context"
+	"fmt"
+	"github.com/apache/arrow/go/arrow/flight"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authenticator attaches dremio credentials to the outgoing context of a flight client
+type Authenticator interface {
+	// Authenticate returns ctx with whatever headers subsequent calls need to be authorized
+	Authenticate(ctx context.Context, fc flight.Client) (context.Context, error)
+	// Changed reports whether the credentials have changed since the given time,
+	// in which case clients should authenticate again before their next call
+	Changed(since time.Time) bool
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+// BasicAuth authenticates with a username and password handshake, the returned bearer token is used for all calls
+func BasicAuth(username, password string) Authenticator {
+	return basicAuth{username: username, password: password}
+}
+
+func (a basicAuth) Authenticate(ctx context.Context, fc flight.Client) (context.Context, error) {
+	return fc.AuthenticateBasicToken(ctx, a.username, a.password)
+}
+
+func (a basicAuth) Changed(since time.Time) bool {
+	return false
+}
+
+type tokenAuth struct {
+	token string
+}
+
+// TokenAuth sends a personal access token as a bearer token with every call
+func TokenAuth(token string) Authenticator {
+	return tokenAuth{token: token}
+}
+
+func (a tokenAuth) Authenticate(ctx context.Context, fc flight.Client) (context.Context, error) {
+	return bearer(ctx, a.token), nil
+}
+
+func (a tokenAuth) Changed(since time.Time) bool {
+	return false
+}
+
+type tokenFileAuth struct {
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+}
+
+// TokenFileAuth sends the token stored in path as a bearer token with every call.
+// The file is read again whenever it is modified so tokens can be rotated on disk.
+func TokenFileAuth(path string) Authenticator {
+	return &tokenFileAuth{path: path}
+}
+
+func (a *tokenFileAuth) Authenticate(ctx context.Context, fc flight.Client) (context.Context, error) {
+	token, err := a.read()
+	if err != nil {
+		return ctx, err
+	}
+	return bearer(ctx, token), nil
+}
+
+func (a *tokenFileAuth) Changed(since time.Time) bool {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		// let the next Authenticate surface the error
+		return true
+	}
+	return fi.ModTime().After(since)
+}
+
+// read returns the token in a.path, only reading the file when it has been modified
+func (a *tokenFileAuth) read() (string, error) {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && fi.ModTime().Equal(a.modTime) {
+		return a.token, nil
+	}
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file is empty: %s", a.path)
+	}
+	a.token, a.modTime = token, fi.ModTime()
+	return token, nil
+}
+
+func bearer(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
@@ -0,0 +1,240 @@
+// Package flighttest provides an in-process arrow flight server that stands in for dremio in tests.
+// it records every statement it receives and answers them with scripted results.
+package flighttest
+
+import (
+	"context"
+	"errors"
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/flight"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// credentials accepted by the server's basic auth handshake
+const (
+	Username = "smile"
+	Password = "secret"
+	// bearer token handed out by the handshake, it is also accepted without one
+	Token = "flighttest-token"
+)
+
+// Result is the scripted answer to a statement
+type Result struct {
+	schema  *arrow.Schema
+	columns func(memory.Allocator) []array.Interface
+	rows    int64
+	err     error
+}
+
+// Records answers with a single "Records" row holding n, the way dremio reports affected rows
+func Records(n int64) Result {
+	return Rows([]string{"Records"}, []interface{}{n})
+}
+
+// Strings answers with one row per value in a single utf8 column named name
+func Strings(name string, values ...string) Result {
+	rows := make([][]interface{}, len(values))
+	for i, v := range values {
+		rows[i] = []interface{}{v}
+	}
+	return Rows([]string{name}, rows...)
+}
+
+// Rows answers with rows of the named columns. values may be string, int32 or int64, the type of
+// a column is that of its value in the first row, columns of a result without rows are utf8.
+func Rows(names []string, rows ...[]interface{}) Result {
+	fields := make([]arrow.Field, len(names))
+	for j, name := range names {
+		fields[j] = arrow.Field{Name: name, Type: arrow.BinaryTypes.String}
+		if len(rows) == 0 {
+			continue
+		}
+		switch rows[0][j].(type) {
+		case int32:
+			fields[j].Type = arrow.PrimitiveTypes.Int32
+		case int64:
+			fields[j].Type = arrow.PrimitiveTypes.Int64
+		}
+	}
+	return Result{
+		schema: arrow.NewSchema(fields, nil),
+		columns: func(mem memory.Allocator) []array.Interface {
+			cols := make([]array.Interface, len(fields))
+			for j, f := range fields {
+				b := array.NewBuilder(mem, f.Type)
+				for _, row := range rows {
+					switch v := row[j].(type) {
+					case string:
+						b.(*array.StringBuilder).Append(v)
+					case int32:
+						b.(*array.Int32Builder).Append(v)
+					case int64:
+						b.(*array.Int64Builder).Append(v)
+					}
+				}
+				cols[j] = b.NewArray()
+				b.Release()
+			}
+			return cols
+		},
+		rows: int64(len(rows)),
+	}
+}
+
+// Error fails the statement's GetFlightInfo call with a grpc status
+func Error(code codes.Code, msg string) Result {
+	return Result{err: status.Error(code, msg)}
+}
+
+// rule answers statements starting with prefix, results are used in turn and the last one repeats
+type rule struct {
+	prefix  string
+	results []Result
+}
+
+// Server is an arrow flight server listening on a loopback port. statements without a
+// matching Respond rule are answered with Records(1).
+type Server struct {
+	// Host and Port the server listens on
+	Host string
+	Port string
+
+	srv flight.Server
+
+	mu         sync.Mutex
+	statements []string
+	rules      []*rule
+	// results of GetFlightInfo calls waiting to be fetched by DoGet, keyed by ticket
+	pending map[string]Result
+	tickets int
+}
+
+// NewServer starts a server, call Close to stop it
+func NewServer() (*Server, error) {
+	s := &Server{pending: make(map[string]Result)}
+	s.srv = flight.NewServerWithMiddleware(nil, []flight.ServerMiddleware{flight.CreateServerBasicAuthMiddleware(s)})
+	s.srv.RegisterFlightService(&flight.FlightServiceService{
+		GetFlightInfo: s.getFlightInfo,
+		DoGet:         s.doGet,
+	})
+	if err := s.srv.Init("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	go s.srv.Serve()
+	host, port, err := net.SplitHostPort(s.srv.Addr().String())
+	if err != nil {
+		s.srv.Shutdown()
+		return nil, err
+	}
+	s.Host, s.Port = host, port
+	return s, nil
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.srv.Shutdown()
+}
+
+// Respond scripts the answers to statements starting with prefix, ignoring case. the n-th matching
+// statement gets results[n], once they are used up the last result answers every further statement.
+// rules are tried in the order they were added.
+func (s *Server) Respond(prefix string, results ...Result) {
+	if len(results) == 0 {
+		results = []Result{Records(1)}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, &rule{prefix: strings.ToLower(prefix), results: results})
+}
+
+// Statements returns the statements received so far, in order
+func (s *Server) Statements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.statements...)
+}
+
+// Reset forgets the received statements and all Respond rules
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = nil
+	s.rules = nil
+}
+
+func (s *Server) Validate(username, password string) (string, error) {
+	if username != Username || password != Password {
+		return "", errors.New("invalid credentials")
+	}
+	return Token, nil
+}
+
+func (s *Server) IsValid(bearerToken string) (interface{}, error) {
+	if bearerToken != Token {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return Username, nil
+}
+
+// result records stmt and returns the answer scripted for it
+func (s *Server) result(stmt string) Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = append(s.statements, stmt)
+	lower := strings.ToLower(stmt)
+	for _, r := range s.rules {
+		if !strings.HasPrefix(lower, r.prefix) {
+			continue
+		}
+		res := r.results[0]
+		if len(r.results) > 1 {
+			r.results = r.results[1:]
+		}
+		return res
+	}
+	return Records(1)
+}
+
+func (s *Server) getFlightInfo(ctx context.Context, desc *flight.FlightDescriptor) (*flight.FlightInfo, error) {
+	res := s.result(string(desc.Cmd))
+	if res.err != nil {
+		return nil, res.err
+	}
+	s.mu.Lock()
+	s.tickets++
+	tkt := strconv.Itoa(s.tickets)
+	s.pending[tkt] = res
+	s.mu.Unlock()
+	return &flight.FlightInfo{
+		FlightDescriptor: desc,
+		Endpoint:         []*flight.FlightEndpoint{{Ticket: &flight.Ticket{Ticket: []byte(tkt)}}},
+		TotalRecords:     res.rows,
+	}, nil
+}
+
+func (s *Server) doGet(tkt *flight.Ticket, stream flight.FlightService_DoGetServer) error {
+	s.mu.Lock()
+	res, ok := s.pending[string(tkt.Ticket)]
+	delete(s.pending, string(tkt.Ticket))
+	s.mu.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "unknown ticket")
+	}
+	cols := res.columns(memory.DefaultAllocator)
+	for _, col := range cols {
+		defer col.Release()
+	}
+	rec := array.NewRecord(res.schema, cols, res.rows)
+	defer rec.Release()
+	w := flight.NewRecordWriter(stream, ipc.WithSchema(res.schema))
+	defer w.Close()
+	return w.Write(rec)
+}
@@ -0,0 +1,19 @@
+package arrowflight
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "dremio_gateway",
+		Name:      "flight_connection_failures_total",
+		Help:      "Arrow flight calls that failed because dremio could not be reached.",
+	})
+	authFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "dremio_gateway",
+		Name:      "flight_auth_failures_total",
+		Help:      "Failed attempts to authenticate with dremio.",
+	})
+)
@@ -0,0 +1,138 @@
+package arrowflight
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("arrow flight pool is closed")
+
+// Pool hands out authenticated ArrowFlight clients. Clients are created on demand,
+// up to size, and are kept open between uses so we only authenticate once per client.
+// Creating them on first use rather than in NewPool lets the service start while dremio
+// is down, its readiness check reports the outage instead.
+type Pool struct {
+	args ArrowFlightArgs
+
+	sem  chan struct{}
+	idle chan *ArrowFlight
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewPool(args ArrowFlightArgs, size int) (*Pool, error) {
+	if args.Host == "" {
+		return nil, errors.New("host must not be empty")
+	}
+	if size < 1 {
+		return nil, errors.New("pool size must be greater than zero")
+	}
+	return &Pool{
+		args: args,
+		sem:  make(chan struct{}, size),
+		idle: make(chan *ArrowFlight, size),
+	}, nil
+}
+
+// Get returns an idle client or creates a new one, blocking while size clients are in use.
+// Every client obtained from Get must be returned via Put or Discard.
+func (p *Pool) Get(ctx context.Context) (*ArrowFlight, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.isClosed() {
+		<-p.sem
+		return nil, ErrPoolClosed
+	}
+	select {
+	case af := <-p.idle:
+		return af, nil
+	default:
+	}
+	af, err := NewArrowFlight(ctx, p.args)
+	if err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return af, nil
+}
+
+// Put returns a healthy client to the pool
+func (p *Pool) Put(af *ArrowFlight) {
+	p.mu.Lock()
+	if p.closed {
+		af.Close()
+	} else {
+		p.idle <- af
+	}
+	p.mu.Unlock()
+	<-p.sem
+}
+
+// Discard closes a client that should not be reused and frees its slot in the pool
+func (p *Pool) Discard(af *ArrowFlight) {
+	af.Close()
+	<-p.sem
+}
+
+// Release returns af to the pool after a call that ended with err. Clients whose connection
+// failed or whose credentials were rejected are discarded, so the next Get dials afresh.
+func (p *Pool) Release(af *ArrowFlight, err error) {
+	if broken(err) {
+		p.Discard(af)
+		return
+	}
+	p.Put(af)
+}
+
+// broken reports whether err leaves the client that returned it unfit for reuse
+func broken(err error) bool {
+	switch grpcCode(err) {
+	case codes.Unavailable, codes.Unauthenticated:
+		return true
+	}
+	return false
+}
+
+// grpcCode returns the code of the grpc status err wraps. unlike status.Code it looks through
+// wrapping, such as that of the errors of the flight record reader.
+func grpcCode(err error) codes.Code {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
+
+// Close closes all idle clients, clients still in use are closed when they are returned
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	var err error
+	for {
+		select {
+		case af := <-p.idle:
+			if cerr := af.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		default:
+			return err
+		}
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
@@ -0,0 +1,57 @@
+package arrowflight
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"os"
+)
+
+type TLSArgs struct {
+	Enabled bool
+	// PEM bundle used to verify the server certificate, system roots are used when empty
+	CAPath string
+	// client certificate and key, only needed when the server requires mutual tls
+	CertPath string
+	KeyPath  string
+	// overrides the server name used for certificate verification
+	ServerName string
+	// disables server certificate verification, for development only
+	SkipVerify bool
+}
+
+// dialOption returns the grpc transport credentials described by args
+func (args TLSArgs) dialOption() (grpc.DialOption, error) {
+	if !args.Enabled {
+		return grpc.WithInsecure(), nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         args.ServerName,
+		InsecureSkipVerify: args.SkipVerify,
+	}
+	if args.CAPath != "" {
+		pem, err := os.ReadFile(args.CAPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca bundle: %s", args.CAPath)
+		}
+	}
+	if (args.CertPath == "") != (args.KeyPath == "") {
+		return nil, errors.New("tls certpath and keypath must be set together")
+	}
+	if args.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(args.CertPath, args.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
@@ -0,0 +1,31 @@
+package arrowflight
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/mskcc/smile-dremio-gateway/internal/arrowflight")
+
+// startCallSpan starts a client span for the flight rpc method
+func startCallSpan(ctx context.Context, method string, op Operation) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "flight."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.RPCSystemKey.String("grpc"),
+		semconv.RPCService("arrow.flight.protocol.FlightService"),
+		semconv.RPCMethod(method),
+		attribute.String("dremio.operation", string(op)),
+	))
+}
+
+// endCallSpan records err on span, if any
+func endCallSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
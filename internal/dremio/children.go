@@ -0,0 +1,220 @@
+package dremio
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"strconv"
+	"strings"
+)
+
+// childTable is a table of rows derived from the samples, such as their libraries, so they can be
+// queried without parsing SAMPLE_JSON. every row starts with the IGO_REQUEST_ID and SMILE_SAMPLE_ID
+// of its sample, the rows of a sample are replaced whenever it is written and removed with it.
+type childTable struct {
+	// name under args.ObjectStore and its quoted path
+	name string
+	path string
+	// label of the statements writing the table
+	kind    string
+	columns []columnDef
+	// rows returns the values of the rows of s following IGO_REQUEST_ID and SMILE_SAMPLE_ID
+	rows func(s smile.Sample) [][]interface{}
+	// quoted path of the view joining the table to the samples, empty when there is none
+	view string
+}
+
+// childKeyColumns start the columns of every child table
+var childKeyColumns = varchars("IGO_REQUEST_ID", "SMILE_SAMPLE_ID")
+
+var (
+	libraryColumns = append(varchars("LIBRARY_IGO_ID"), columnDef{"LIBRARY_CONCENTRATION_NGUL", "DOUBLE"},
+		columnDef{"CAPTURE_CONCENTRATION_NM", "VARCHAR"}, columnDef{"CAPTURE_INPUT_NG", "VARCHAR"}, columnDef{"CAPTURE_NAME", "VARCHAR"})
+	// FLOW_CELL_LANES holds the lane numbers separated by commas
+	runColumns   = varchars("LIBRARY_IGO_ID", "RUN_ID", "RUN_MODE", "FLOW_CELL_ID", "READ_LENGTH", "RUN_DATE", "FLOW_CELL_LANES")
+	fastqColumns = varchars("LIBRARY_IGO_ID", "RUN_ID", "FASTQ_PATH")
+	// ALIAS_VALUE holds the value of the alias, VALUE being a reserved word
+	sampleAliasColumns = varchars("NAMESPACE", "ALIAS_VALUE")
+	qcReportColumns    = varchars("QC_REPORT_TYPE", "COMMENTS", "INVESTIGATOR_DECISION")
+)
+
+func libraryRows(s smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, l := range s.Libraries {
+		rows = append(rows, []interface{}{l.LibraryIgoID, l.LibraryConcentrationNgul, l.CaptureConcentrationNm, l.CaptureInputNg, l.CaptureName})
+	}
+	return rows
+}
+
+func runRows(s smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, l := range s.Libraries {
+		for _, run := range l.Runs {
+			lanes := make([]string, len(run.FlowCellLanes))
+			for i, lane := range run.FlowCellLanes {
+				lanes[i] = strconv.Itoa(lane)
+			}
+			rows = append(rows, []interface{}{l.LibraryIgoID, run.RunID, run.RunMode, run.FlowCellID, run.ReadLength, run.RunDate, strings.Join(lanes, ",")})
+		}
+	}
+	return rows
+}
+
+func fastqRows(s smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, l := range s.Libraries {
+		for _, run := range l.Runs {
+			for _, fastq := range run.Fastqs {
+				rows = append(rows, []interface{}{l.LibraryIgoID, run.RunID, fastq})
+			}
+		}
+	}
+	return rows
+}
+
+func sampleAliasRows(s smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, a := range s.SampleAliases {
+		rows = append(rows, []interface{}{a.Namespace, a.Value})
+	}
+	return rows
+}
+
+func qcReportRows(s smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, q := range s.QcReports {
+		rows = append(rows, []interface{}{q.QcReportType, q.Comments, q.InvestigatorDecision})
+	}
+	return rows
+}
+
+// newChildTables returns the child tables enabled by args, a table is enabled by naming it
+func newChildTables(args DremioArgs) ([]childTable, error) {
+	// views are named by dotted paths until they are quoted below
+	candidates := []childTable{
+		{name: args.LibraryTable, kind: "libraries", columns: libraryColumns, rows: libraryRows},
+		{name: args.RunTable, kind: "runs", columns: runColumns, rows: runRows},
+		{name: args.FastqTable, kind: "fastqs", columns: fastqColumns, rows: fastqRows},
+		{name: args.SampleAliasTable, kind: "sample_aliases", columns: sampleAliasColumns, rows: sampleAliasRows, view: args.SampleAliasView},
+		{name: args.QcReportTable, kind: "qc_reports", columns: qcReportColumns, rows: qcReportRows, view: args.QcReportView},
+	}
+	var tables []childTable
+	for _, t := range candidates {
+		if t.name == "" {
+			if t.view != "" {
+				return nil, fmt.Errorf("view %s needs the table of %s to be named", t.view, t.kind)
+			}
+			continue
+		}
+		path, err := tablePath(args.ObjectStore, t.name)
+		if err != nil {
+			return nil, err
+		}
+		t.path = path
+		if t.view != "" {
+			if t.view, err = viewPath(t.view); err != nil {
+				return nil, err
+			}
+		}
+		t.columns = append(childKeyColumns[:len(childKeyColumns):len(childKeyColumns)], t.columns...)
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// childRows returns the rows of t for the samples of request igoRequestID. samples without a
+// SmileSampleID have no rows, they could not be told apart from each other.
+func (t childTable) childRows(igoRequestID string, samples ...smile.Sample) [][]interface{} {
+	var rows [][]interface{}
+	for _, s := range samples {
+		if s.SmileSampleID == uuid.Nil {
+			continue
+		}
+		for _, row := range t.rows(s) {
+			rows = append(rows, append([]interface{}{igoRequestID, s.SmileSampleID}, row...))
+		}
+	}
+	return rows
+}
+
+// insertChildren writes the child table rows of samples of request igoRequestID in batches
+func (r *DremioRepository) insertChildren(ctx context.Context, af *arrowflight.ArrowFlight, igoRequestID string, samples ...smile.Sample) error {
+	for _, t := range r.children {
+		rows := t.childRows(igoRequestID, samples...)
+		for _, c := range r.batches(rows) {
+			query := insertStmt(t.path, columnNames(t.columns), rows[c[0]:c[1]]...)
+			if _, err := r.exec(ctx, af, "insert_"+t.kind, arrowflight.OpInsert, query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteChildren removes the child table rows matching where
+func (r *DremioRepository) deleteChildren(ctx context.Context, af *arrowflight.ArrowFlight, where column) error {
+	for _, t := range r.children {
+		if _, err := r.exec(ctx, af, "delete_"+t.kind, arrowflight.OpDelete, deleteStmt(t.path, where)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceChildren replaces the child table rows of all samples of sr with those of its current samples
+func (r *DremioRepository) replaceChildren(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	if err := r.deleteChildren(ctx, af, column{"IGO_REQUEST_ID", sr.IgoRequestID}); err != nil {
+		return err
+	}
+	return r.insertChildren(ctx, af, sr.IgoRequestID, sr.Samples...)
+}
+
+// replaceSampleChildren replaces the child table rows of the stored sample old with those of s.
+// a sample without a SmileSampleID has no rows, so there is nothing to delete for it.
+func (r *DremioRepository) replaceSampleChildren(ctx context.Context, af *arrowflight.ArrowFlight, old, s smile.Sample) error {
+	if old.SmileSampleID != uuid.Nil {
+		if err := r.deleteChildren(ctx, af, column{"SMILE_SAMPLE_ID", old.SmileSampleID}); err != nil {
+			return err
+		}
+	}
+	if s.SmileSampleID != old.SmileSampleID && s.SmileSampleID != uuid.Nil {
+		if err := r.deleteChildren(ctx, af, column{"SMILE_SAMPLE_ID", s.SmileSampleID}); err != nil {
+			return err
+		}
+	}
+	return r.insertChildren(ctx, af, s.AdditionalProperties.IgoRequestID, s)
+}
+
+// viewQuery builds the query of the view of t, which lists the rows of t along with the identifiers
+// of their samples. samples are matched on their mapped smileSampleId column if there is one, on
+// the smileSampleId of their SAMPLE_JSON otherwise.
+func (r *DremioRepository) viewQuery(t childTable) string {
+	smileSampleID := "cast(convert_from(s.SAMPLE_JSON, 'JSON')['smileSampleId'] as VARCHAR)"
+	for _, c := range r.args.SampleColumns {
+		if c.Field == "smileSampleId" {
+			smileSampleID = "s." + c.Column
+			break
+		}
+	}
+	cols := []string{"s.IGO_REQUEST_ID", "s.IGO_SAMPLE_NAME", "s.CMO_SAMPLE_NAME", "s.CMO_PATIENT_ID", "c.SMILE_SAMPLE_ID"}
+	for _, c := range t.columns[len(childKeyColumns):] {
+		cols = append(cols, "c."+c.name)
+	}
+	return fmt.Sprintf("select %s from %s as s join %s as c on c.IGO_REQUEST_ID = s.IGO_REQUEST_ID and c.SMILE_SAMPLE_ID = %s",
+		strings.Join(cols, ", "), r.sampleTable, t.path, smileSampleID)
+}
+
+// createViews creates or replaces the views of the child tables, see viewQuery
+func (r *DremioRepository) createViews(ctx context.Context, af *arrowflight.ArrowFlight) error {
+	for _, t := range r.children {
+		if t.view == "" {
+			continue
+		}
+		if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, createViewStmt(t.view, r.viewQuery(t))); err != nil {
+			return fmt.Errorf("cannot create view %s: %w", t.view, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package dremio_test
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight/flighttest"
+	"github.com/mskcc/smile-dremio-gateway/internal/dremio"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"testing"
+)
+
+const (
+	libraryTable = `"local-minio"."smile"."libraries"`
+	runTable     = `"local-minio"."smile"."runs"`
+	fastqTable   = `"local-minio"."smile"."fastqs"`
+)
+
+// childArgs enables all child tables
+func childArgs() dremio.DremioArgs {
+	args := dArgs
+	args.LibraryTable, args.RunTable, args.FastqTable = "libraries", "runs", "fastqs"
+	return args
+}
+
+// childInserts returns the statements writing the child table rows of the first sample of
+// newRequest, or of updatedSample, with the given smile sample id
+func childInserts(smileSampleID string) []string {
+	key := "'22022_BZ', '" + smileSampleID + "', '22022_CC_3_1'"
+	fastq := "'/FASTQ/Project_22022_CC/Sample_LMNO_4396_N_IGO_22022_CC_3/LMNO_4396_N_IGO_22022_CC_3_S144_R%s_001.fastq.gz'"
+	return []string{
+		"insert into " + libraryTable + " (IGO_REQUEST_ID, SMILE_SAMPLE_ID, LIBRARY_IGO_ID, LIBRARY_CONCENTRATION_NGUL, CAPTURE_CONCENTRATION_NM, CAPTURE_INPUT_NG, CAPTURE_NAME)" +
+			" values (" + key + ", 34.2, '1.461988304093567', '50.0', 'Pool-22022_BZ-22022_CC-Tube7_1')",
+		"insert into " + runTable + " (IGO_REQUEST_ID, SMILE_SAMPLE_ID, LIBRARY_IGO_ID, RUN_ID, RUN_MODE, FLOW_CELL_ID, READ_LENGTH, RUN_DATE, FLOW_CELL_LANES)" +
+			" values (" + key + ", 'CRX_7395', 'HiSeq High Output', 'HGJMLBBXY', '101/8/8/101', '2020-05-20', '1,2,3,4,5,6,7')",
+		"insert into " + fastqTable + " (IGO_REQUEST_ID, SMILE_SAMPLE_ID, LIBRARY_IGO_ID, RUN_ID, FASTQ_PATH)" +
+			" values (" + key + ", 'CRX_7395', " + strings.Replace(fastq, "%s", "1", 1) + "), (" + key + ", 'CRX_7395', " + strings.Replace(fastq, "%s", "2", 1) + ")",
+	}
+}
+
+// childDeletes returns the statements removing the child table rows matching where
+func childDeletes(where string) []string {
+	return []string{
+		"delete from " + libraryTable + " where " + where,
+		"delete from " + runTable + " where " + where,
+		"delete from " + fastqTable + " where " + where,
+	}
+}
+
+func TestNewRequestChildTables(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	fs, dr := newTestRepos(t, childArgs())
+	stored := r
+	stored.Samples = nil
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON", marshal(t, stored)))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	// the rows of the stored samples are removed along with them
+	want := []string{
+		"select * from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		"delete from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'",
+	}
+	want = append(want, childDeletes("IGO_REQUEST_ID = '22022_BZ'")...)
+	want = append(want, sampleInsert(t, "22022_BZ", r.Samples...))
+	want = append(want, childInserts("afe74fba-8756-11eb-9b45-acde48001122")...)
+	assertStatements(t, fs, append(want, addRequestStatements(t, r)[1]))
+}
+
+func TestNewRequestChildTablesRemovedOnFailure(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	fs, dr := newTestRepos(t, childArgs())
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	fs.Respond("insert into "+runTable, flighttest.Error(codes.InvalidArgument, "bad run"))
+
+	if err := dr.AddRequest(context.Background(), r); err == nil {
+		t.Fatal("expected error")
+	}
+	got := fs.Statements()
+	want := append([]string{"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'"}, childDeletes("IGO_REQUEST_ID = '22022_BZ'")...)
+	if len(got) < len(want) || strings.Join(got[len(got)-len(want):], "\n") != strings.Join(want, "\n") {
+		t.Errorf("got statements\n%s\nwant the samples and their child rows to be removed last", strings.Join(got, "\n"))
+	}
+}
+
+func TestNewRequestMergeChildTables(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	args := childArgs()
+	args.AddStrategy = dremio.AddMerge
+	fs, dr := newTestRepos(t, args)
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	got := fs.Statements()
+	// merge samples, delete stale samples, the child tables, merge request
+	want := append(childDeletes("IGO_REQUEST_ID = '22022_BZ'"), childInserts("afe74fba-8756-11eb-9b45-acde48001122")...)
+	if len(got) != len(want)+3 {
+		t.Fatalf("got %d statements, want %d:\n%s", len(got), len(want)+3, strings.Join(got, "\n"))
+	}
+	for i, stmt := range want {
+		if got[i+2] != stmt {
+			t.Errorf("statement %d:\ngot  %s\nwant %s", i+2, got[i+2], stmt)
+		}
+	}
+	if !strings.HasPrefix(got[len(got)-1], "merge into "+requestTable) {
+		t.Errorf("last statement %.100s, want the request to be merged last", got[len(got)-1])
+	}
+}
+
+func TestUpdateSampleChildTables(t *testing.T) {
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	s[0].SmileSampleID = uuid.MustParse("afe74fba-8756-11eb-9b45-acde48001122")
+	s[1].SmileSampleID = s[0].SmileSampleID
+	fs, dr := newTestRepos(t, childArgs())
+
+	if err := dr.UpdateSample(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	got := fs.Statements()
+	want := append(childDeletes("SMILE_SAMPLE_ID = 'afe74fba-8756-11eb-9b45-acde48001122'"), childInserts("afe74fba-8756-11eb-9b45-acde48001122")...)
+	if len(got) != len(want)+1 || !strings.HasPrefix(got[0], "update "+sampleTable) {
+		t.Fatalf("got statements\n%s\nwant the sample update followed by its child rows", strings.Join(got, "\n"))
+	}
+	for i, stmt := range want {
+		if got[i+1] != stmt {
+			t.Errorf("statement %d:\ngot  %s\nwant %s", i+1, got[i+1], stmt)
+		}
+	}
+
+	// a sample that was not updated keeps its child rows
+	fs.Reset()
+	fs.Respond("update", flighttest.Records(0))
+	if err := dr.UpdateSample(context.Background(), s); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := fs.Statements(); len(got) != 2 {
+		t.Errorf("got %d statements, want only the updates", len(got))
+	}
+}
+
+func TestUpdateSampleRetryAfterUpdate(t *testing.T) {
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	s[0].SmileSampleID = uuid.MustParse("afe74fba-8756-11eb-9b45-acde48001122")
+	s[1].SmileSampleID = s[0].SmileSampleID
+	fs, dr := newTestRepos(t, childArgs())
+	// the update is committed, then the child rows fail once. the retried update no longer
+	// finds the row by the key of s[1] but by that of s[0]
+	fs.Respond("update", flighttest.Records(1), flighttest.Records(0), flighttest.Records(1))
+	fs.Respond("delete from "+libraryTable, flighttest.Error(codes.Unavailable, "dremio is restarting"), flighttest.Records(1))
+
+	if err := dr.UpdateSample(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	got := fs.Statements()
+	want := append(childDeletes("SMILE_SAMPLE_ID = 'afe74fba-8756-11eb-9b45-acde48001122'"), childInserts("afe74fba-8756-11eb-9b45-acde48001122")...)
+	if len(got) != len(want)+4 || got[2] != got[0] || !strings.HasSuffix(got[3], " where "+sampleWhere(s[0])) {
+		t.Fatalf("got statements\n%s\nwant the update to be retried on the key of the updated sample", strings.Join(got, "\n"))
+	}
+	if strings.Join(got[4:], "\n") != strings.Join(want, "\n") {
+		t.Errorf("got statements\n%s\nwant the child rows to be replaced", strings.Join(got[4:], "\n"))
+	}
+}
+
+func TestUpdateSampleSingleVersionRetry(t *testing.T) {
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	s[0].SmileSampleID = uuid.MustParse("afe74fba-8756-11eb-9b45-acde48001122")
+	fs, dr := newTestRepos(t, childArgs())
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON", `{"igoRequestId":"22022_BZ"}`))
+	// the sample is inserted, then the child rows fail once
+	fs.Respond("delete from "+libraryTable, flighttest.Error(codes.Unavailable, "dremio is restarting"), flighttest.Records(1))
+
+	if err := dr.UpdateSample(context.Background(), s[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// every attempt removes the sample inserted by the one before
+	deleteSample := "delete from " + sampleTable + " where " + sampleWhere(s[0])
+	insert := sampleInsert(t, "22022_BZ", s[0])
+	got := fs.Statements()
+	if len(got) < 7 || got[1] != deleteSample || got[2] != insert || got[5] != deleteSample || got[6] != insert {
+		t.Errorf("got statements\n%s\nwant the sample to be deleted before each insert", strings.Join(got, "\n"))
+	}
+}
+
+func TestChildTablesSkipSamplesWithoutID(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	r.Samples[0].SmileSampleID = uuid.Nil
+	fs, dr := newTestRepos(t, childArgs())
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+
+	// a sample without an id in one request gets no child rows
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range fs.Statements() {
+		if strings.HasPrefix(stmt, "insert into "+libraryTable) || strings.HasPrefix(stmt, "insert into "+runTable) ||
+			strings.HasPrefix(stmt, "insert into "+fastqTable) {
+			t.Errorf("child rows written for a sample without an id: %.100s", stmt)
+		}
+	}
+
+	// updating another sample without an id, in another request, leaves the child rows alone
+	fs.Reset()
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	s[0].AdditionalProperties.IgoRequestID, s[1].AdditionalProperties.IgoRequestID = "22022_CC", "22022_CC"
+	if err := dr.UpdateSample(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Statements(); len(got) != 1 || !strings.HasPrefix(got[0], "update "+sampleTable) {
+		t.Errorf("got statements\n%s\nwant only the sample update", strings.Join(got, "\n"))
+	}
+}
+
+func TestMigrateChildTables(t *testing.T) {
+	fs, dr := newTestRepos(t, childArgs())
+	fs.Respond("select VERSION", versionsResult(1))
+	respondSchema(fs)
+	fs.Respond(columnsQuery("libraries"), columnsResult("IGO_REQUEST_ID CHARACTER VARYING", "SMILE_SAMPLE_ID CHARACTER VARYING",
+		"LIBRARY_IGO_ID CHARACTER VARYING", "LIBRARY_CONCENTRATION_NGUL DOUBLE", "CAPTURE_CONCENTRATION_NM CHARACTER VARYING",
+		"CAPTURE_INPUT_NG CHARACTER VARYING", "CAPTURE_NAME CHARACTER VARYING"))
+	fs.Respond(columnsQuery("runs"), columnsResult("IGO_REQUEST_ID CHARACTER VARYING", "SMILE_SAMPLE_ID CHARACTER VARYING",
+		"LIBRARY_IGO_ID CHARACTER VARYING", "RUN_ID CHARACTER VARYING", "RUN_MODE CHARACTER VARYING", "FLOW_CELL_ID CHARACTER VARYING",
+		"READ_LENGTH CHARACTER VARYING", "RUN_DATE CHARACTER VARYING", "FLOW_CELL_LANES CHARACTER VARYING"))
+	// the fastq table was not created
+	fs.Respond(columnsQuery("fastqs"), columnsResult())
+
+	err := dr.Migrate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "table fastqs does not exist") {
+		t.Fatalf("Migrate returned %v, want the missing fastq table to be reported", err)
+	}
+	got := fs.Statements()
+	want := []string{
+		"create table if not exists " + libraryTable + " (IGO_REQUEST_ID VARCHAR, SMILE_SAMPLE_ID VARCHAR, LIBRARY_IGO_ID VARCHAR," +
+			" LIBRARY_CONCENTRATION_NGUL DOUBLE, CAPTURE_CONCENTRATION_NM VARCHAR, CAPTURE_INPUT_NG VARCHAR, CAPTURE_NAME VARCHAR)",
+		"create table if not exists " + runTable + " (IGO_REQUEST_ID VARCHAR, SMILE_SAMPLE_ID VARCHAR, LIBRARY_IGO_ID VARCHAR, RUN_ID VARCHAR," +
+			" RUN_MODE VARCHAR, FLOW_CELL_ID VARCHAR, READ_LENGTH VARCHAR, RUN_DATE VARCHAR, FLOW_CELL_LANES VARCHAR)",
+		"create table if not exists " + fastqTable + " (IGO_REQUEST_ID VARCHAR, SMILE_SAMPLE_ID VARCHAR, LIBRARY_IGO_ID VARCHAR, RUN_ID VARCHAR, FASTQ_PATH VARCHAR)",
+	}
+	if len(got) < 2+len(want) || strings.Join(got[2:2+len(want)], "\n") != strings.Join(want, "\n") {
+		t.Errorf("got statements\n%s\nwant the child tables to be created after the migrations", strings.Join(got, "\n"))
+	}
+}
+
+const (
+	sampleAliasTable = `"local-minio"."smile"."sample_aliases"`
+	qcReportTable    = `"local-minio"."smile"."qc_reports"`
+)
+
+// aliasArgs enables the sample alias and qc report tables along with their views
+func aliasArgs() dremio.DremioArgs {
+	args := dArgs
+	args.SampleAliasTable, args.QcReportTable = "sample_aliases", "qc_reports"
+	args.SampleAliasView, args.QcReportView = "smile.sample_aliases", `smile."qc reports"`
+	return args
+}
+
+func TestUpdateSampleAliasAndQcReportTables(t *testing.T) {
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	s[0].SmileSampleID = uuid.MustParse("afe74fba-8756-11eb-9b45-acde48001122")
+	s[1].SmileSampleID = s[0].SmileSampleID
+	s[0].QcReports = append(s[0].QcReports, smile.QcReports{QcReportType: "IGO", Comments: "low yield", InvestigatorDecision: "Stop"})
+	fs, dr := newTestRepos(t, aliasArgs())
+
+	if err := dr.UpdateSample(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	where := " where SMILE_SAMPLE_ID = 'afe74fba-8756-11eb-9b45-acde48001122'"
+	key := "'22022_BZ', 'afe74fba-8756-11eb-9b45-acde48001122', "
+	want := []string{
+		"delete from " + sampleAliasTable + where,
+		"delete from " + qcReportTable + where,
+		"insert into " + sampleAliasTable + " (IGO_REQUEST_ID, SMILE_SAMPLE_ID, NAMESPACE, ALIAS_VALUE)" +
+			" values (" + key + "'igoId', '22022_CC_3'), (" + key + "'investigatorId', 'LMNO_4396_N')",
+		"insert into " + qcReportTable + " (IGO_REQUEST_ID, SMILE_SAMPLE_ID, QC_REPORT_TYPE, COMMENTS, INVESTIGATOR_DECISION)" +
+			" values (" + key + "'LIBRARY', '', 'Continue processing'), (" + key + "'IGO', 'low yield', 'Stop')",
+	}
+	got := fs.Statements()
+	if len(got) != len(want)+1 || !strings.HasPrefix(got[0], "update "+sampleTable) {
+		t.Fatalf("got statements\n%s\nwant the sample update followed by its aliases and qc reports", strings.Join(got, "\n"))
+	}
+	for i, stmt := range want {
+		if got[i+1] != stmt {
+			t.Errorf("statement %d:\ngot  %s\nwant %s", i+1, got[i+1], stmt)
+		}
+	}
+}
+
+func TestMigrateChildViews(t *testing.T) {
+	aliasView := `create or replace view "smile"."sample_aliases" as select s.IGO_REQUEST_ID, s.IGO_SAMPLE_NAME, s.CMO_SAMPLE_NAME,` +
+		` s.CMO_PATIENT_ID, c.SMILE_SAMPLE_ID, c.NAMESPACE, c.ALIAS_VALUE from ` + sampleTable + ` as s join ` + sampleAliasTable +
+		` as c on c.IGO_REQUEST_ID = s.IGO_REQUEST_ID and c.SMILE_SAMPLE_ID = `
+	qcView := `create or replace view "smile"."qc reports" as select s.IGO_REQUEST_ID, s.IGO_SAMPLE_NAME, s.CMO_SAMPLE_NAME,` +
+		` s.CMO_PATIENT_ID, c.SMILE_SAMPLE_ID, c.QC_REPORT_TYPE, c.COMMENTS, c.INVESTIGATOR_DECISION from ` + sampleTable + ` as s join ` + qcReportTable +
+		` as c on c.IGO_REQUEST_ID = s.IGO_REQUEST_ID and c.SMILE_SAMPLE_ID = `
+	tests := []struct {
+		name          string
+		cols          []dremio.SampleColumn
+		smileSampleID string
+	}{
+		{"mapped smile sample id", nil, "s.SMILE_SAMPLE_ID"},
+		{"smile sample id from json", []dremio.SampleColumn{}, "cast(convert_from(s.SAMPLE_JSON, 'JSON')['smileSampleId'] as VARCHAR)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := aliasArgs()
+			args.SampleColumns = tt.cols
+			fs, dr := newTestRepos(t, args)
+			fs.Respond("select VERSION", versionsResult(1))
+			respondSchema(fs)
+			fs.Respond(columnsQuery("sample_aliases"), columnsResult("IGO_REQUEST_ID CHARACTER VARYING", "SMILE_SAMPLE_ID CHARACTER VARYING",
+				"NAMESPACE CHARACTER VARYING", "ALIAS_VALUE CHARACTER VARYING"))
+			fs.Respond(columnsQuery("qc_reports"), columnsResult("IGO_REQUEST_ID CHARACTER VARYING", "SMILE_SAMPLE_ID CHARACTER VARYING",
+				"QC_REPORT_TYPE CHARACTER VARYING", "COMMENTS CHARACTER VARYING", "INVESTIGATOR_DECISION CHARACTER VARYING"))
+
+			if err := dr.Migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, stmt := range fs.Statements() {
+				if strings.HasPrefix(stmt, "create or replace view") {
+					got = append(got, stmt)
+				}
+			}
+			want := []string{aliasView + tt.smileSampleID, qcView + tt.smileSampleID}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got views\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestNewDremioReposRejectsViewWithoutTable(t *testing.T) {
+	args := dArgs
+	args.Host, args.Username, args.Password = "localhost", flighttest.Username, flighttest.Password
+	args.QcReportView = "smile.qc_reports"
+	if _, err := dremio.NewDremioRepos(args); err == nil || !strings.Contains(err.Error(), "qc_reports") {
+		t.Fatalf("NewDremioRepos returned %v, want the view without a table to be rejected", err)
+	}
+}
@@ -0,0 +1,171 @@
+package dremio
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SampleColumn maps a field of smile.Sample onto a typed column of the sample table, so it can be
+// queried without parsing SAMPLE_JSON
+type SampleColumn struct {
+	Column string
+	// json name of the field, one of SampleFields
+	Field string
+}
+
+// sampleField is a scalar field of smile.Sample that can be written to a column of its own
+type sampleField struct {
+	typ   string
+	value func(s smile.Sample) interface{}
+}
+
+var sampleFields = map[string]sampleField{
+	"smileSampleId":        {"VARCHAR", func(s smile.Sample) interface{} { return nullUUID(s.SmileSampleID) }},
+	"smilePatientId":       {"VARCHAR", func(s smile.Sample) interface{} { return nullUUID(s.SmilePatientID) }},
+	"sampleType":           {"VARCHAR", func(s smile.Sample) interface{} { return s.SampleType }},
+	"oncotreeCode":         {"VARCHAR", func(s smile.Sample) interface{} { return s.OncotreeCode }},
+	"collectionYear":       {"VARCHAR", func(s smile.Sample) interface{} { return s.CollectionYear }},
+	"tubeId":               {"VARCHAR", func(s smile.Sample) interface{} { return s.TubeID }},
+	"primaryId":            {"VARCHAR", func(s smile.Sample) interface{} { return s.PrimaryID }},
+	"investigatorSampleId": {"VARCHAR", func(s smile.Sample) interface{} { return s.InvestigatorSampleID }},
+	"species":              {"VARCHAR", func(s smile.Sample) interface{} { return s.Species }},
+	"sex":                  {"VARCHAR", func(s smile.Sample) interface{} { return s.Sex }},
+	"tumorOrNormal":        {"VARCHAR", func(s smile.Sample) interface{} { return s.TumorOrNormal }},
+	"preservation":         {"VARCHAR", func(s smile.Sample) interface{} { return s.Preservation }},
+	"sampleClass":          {"VARCHAR", func(s smile.Sample) interface{} { return s.SampleClass }},
+	"sampleOrigin":         {"VARCHAR", func(s smile.Sample) interface{} { return s.SampleOrigin }},
+	"tissueLocation":       {"VARCHAR", func(s smile.Sample) interface{} { return s.TissueLocation }},
+	"baitSet":              {"VARCHAR", func(s smile.Sample) interface{} { return s.BaitSet }},
+	"genePanel":            {"VARCHAR", func(s smile.Sample) interface{} { return s.GenePanel }},
+	"datasource":           {"VARCHAR", func(s smile.Sample) interface{} { return s.Datasource }},
+	"igoComplete":          {"BOOLEAN", func(s smile.Sample) interface{} { return s.IgoComplete }},
+}
+
+// uuidFields are the sampleFields holding a uuid, the nil uuid of a sample without one is stored as null
+var uuidFields = map[string]bool{"smileSampleId": true, "smilePatientId": true}
+
+// SampleFields returns the json names of the fields a SampleColumn can map, sorted
+func SampleFields() []string {
+	fields := make([]string, 0, len(sampleFields))
+	for f := range sampleFields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// DefaultSampleColumns returns the columns written when DremioArgs.SampleColumns is not set
+func DefaultSampleColumns() []SampleColumn {
+	return []SampleColumn{
+		{"SMILE_SAMPLE_ID", "smileSampleId"},
+		{"SMILE_PATIENT_ID", "smilePatientId"},
+		{"ONCOTREE_CODE", "oncotreeCode"},
+		{"SAMPLE_TYPE", "sampleType"},
+		{"TUMOR_OR_NORMAL", "tumorOrNormal"},
+		{"SAMPLE_CLASS", "sampleClass"},
+		{"BAIT_SET", "baitSet"},
+		{"GENE_PANEL", "genePanel"},
+		{"SPECIES", "species"},
+		{"SEX", "sex"},
+		{"IGO_COMPLETE", "igoComplete"},
+	}
+}
+
+// columns are interpolated into statements as is, so only plain identifiers are accepted
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateSampleColumns checks that cols map known fields onto distinct plain identifiers
+// that do not clash with the columns every sample row has
+func validateSampleColumns(cols []SampleColumn) error {
+	seen := make(map[string]bool)
+	for _, c := range sampleSchema {
+		seen[c.name] = true
+	}
+	for _, c := range cols {
+		if !identRE.MatchString(c.Column) {
+			return fmt.Errorf("invalid sample column name: %q", c.Column)
+		}
+		if _, ok := sampleFields[c.Field]; !ok {
+			return fmt.Errorf("unknown sample field %q of column %s, must be one of %s", c.Field, c.Column, strings.Join(SampleFields(), ", "))
+		}
+		name := strings.ToUpper(c.Column)
+		if seen[name] {
+			return fmt.Errorf("duplicate sample column: %s", c.Column)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// sampleColumnDefs returns the definitions of the mapped sample columns
+func (r *DremioRepository) sampleColumnDefs() []columnDef {
+	defs := make([]columnDef, len(r.args.SampleColumns))
+	for i, c := range r.args.SampleColumns {
+		defs[i] = columnDef{c.Column, sampleFields[c.Field].typ}
+	}
+	return defs
+}
+
+// sampleColumns returns the columns of a sample table row, see sampleRow
+func (r *DremioRepository) sampleColumns() []string {
+	return append(columnNames(sampleSchema), columnNames(r.sampleColumnDefs())...)
+}
+
+// mappedValues returns the values of the mapped sample columns of s
+func (r *DremioRepository) mappedValues(s smile.Sample) []column {
+	cols := make([]column, len(r.args.SampleColumns))
+	for i, c := range r.args.SampleColumns {
+		cols[i] = column{c.Column, sampleFields[c.Field].value(s)}
+	}
+	return cols
+}
+
+// backfillStmt builds the update populating cols from SAMPLE_JSON for the stored samples where
+// any of them is null while SAMPLE_JSON has a value for it. samples whose json lacks a field, or
+// holds the nil uuid for it, keep a null column and are not selected again by the next backfill.
+func backfillStmt(tbl string, cols []SampleColumn) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "update %s set ", tbl)
+	for i, c := range cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = %s", c.Column, jsonValue(c.Field))
+	}
+	for i, c := range cols {
+		if i == 0 {
+			b.WriteString(" where ")
+		} else {
+			b.WriteString(" or ")
+		}
+		fmt.Fprintf(&b, "(%s is null and %s is not null)", c.Column, jsonValue(c.Field))
+	}
+	return b.String()
+}
+
+// nullUUID returns id, or nil for the nil uuid of a sample without one
+func nullUUID(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id
+}
+
+// jsonValue returns the expression reading field from the SAMPLE_JSON of a sample row as the
+// value of its column, see sampleField
+func jsonValue(field string) string {
+	v := fmt.Sprintf("cast(%s as %s)", jsonField(field), sampleFields[field].typ)
+	if uuidFields[field] {
+		v = fmt.Sprintf("nullif(%s, %s)", v, quoteLiteral(uuid.Nil.String()))
+	}
+	return v
+}
+
+// jsonField returns the expression reading field from the SAMPLE_JSON of a sample row
+func jsonField(field string) string {
+	return fmt.Sprintf("convert_from(SAMPLE_JSON, 'JSON')[%s]", quoteLiteral(field))
+}
@@ -0,0 +1,64 @@
+package dremio
+
+import (
+	"context"
+	"errors"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+)
+
+// TransientError marks a failure that may go away if the operation is retried later,
+// such as dremio being unavailable or a statement timing out
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Transient allows packages that do not import dremio to recognize transient errors
+func (e *TransientError) Transient() bool {
+	return true
+}
+
+// IsTransient reports whether err, or any error it wraps, is a TransientError
+func IsTransient(err error) bool {
+	var te *TransientError
+	return errors.As(err, &te)
+}
+
+// classify wraps err in a TransientError when retrying the failed operation may succeed,
+// every other error is considered permanent and returned as is
+func classify(err error) error {
+	if err == nil || IsTransient(err) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, arrowflight.ErrPoolClosed) {
+		return &TransientError{err}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return &TransientError{err}
+	}
+	switch grpcCode(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.ResourceExhausted, codes.Aborted:
+		return &TransientError{err}
+	}
+	return err
+}
+
+// grpcCode returns the code of the first grpc status found in err's chain
+func grpcCode(err error) codes.Code {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Code()
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,10 @@
+package dremio
+
+import (
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+)
+
+// Pool returns the client pool of the workers, for tests in package dremio_test
+func (r *DremioRepository) Pool() *arrowflight.Pool {
+	return r.pool
+}
@@ -0,0 +1,201 @@
+package dremio
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	journalExt = ".json"
+	// appended to the name of entries that cannot be read, they are kept for inspection
+	quarantineExt = ".corrupt"
+)
+
+// errCorruptEntry is returned by journalEntry.request for entries that cannot be decoded
+var errCorruptEntry = errors.New("corrupt journal entry")
+
+// journal is a write ahead log of the AddRequest calls in progress. dremio has no transactions
+// spanning the request and sample tables, so an add interrupted by a crash can leave one updated
+// without the other. every add is written to the journal before it starts and removed once it is
+// done, Recover completes whatever is left on restart by running the add again. a nil journal
+// records nothing.
+type journal struct {
+	dir string
+
+	mu   sync.Mutex
+	last int64
+}
+
+// journalEntry is a single add, its file is named <seq>_<hex encoded igo request id>.json
+// so entries sort in the order they were written
+type journalEntry struct {
+	path         string
+	seq          int64
+	igoRequestID string
+}
+
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create journal directory: %w", err)
+	}
+	return &journal{dir: dir}, nil
+}
+
+// nextSeq returns a sequence number larger than all previous ones, based on the clock so
+// they keep increasing across restarts
+func (j *journal) nextSeq() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= j.last {
+		seq = j.last + 1
+	}
+	j.last = seq
+	return seq
+}
+
+// begin durably records that sr is about to be added
+func (j *journal) begin(sr smile.Request) (journalEntry, error) {
+	if j == nil {
+		return journalEntry{}, nil
+	}
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return journalEntry{}, err
+	}
+	e := journalEntry{seq: j.nextSeq(), igoRequestID: sr.IgoRequestID}
+	e.path = filepath.Join(j.dir, fmt.Sprintf("%020d_%s%s", e.seq, hex.EncodeToString([]byte(sr.IgoRequestID)), journalExt))
+	// write to a temporary file first so a crash never leaves a partial entry behind
+	tmp, err := os.CreateTemp(j.dir, ".entry-*")
+	if err != nil {
+		return journalEntry{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return journalEntry{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return journalEntry{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return journalEntry{}, err
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return journalEntry{}, err
+	}
+	return e, nil
+}
+
+// commit removes e along with any older entries of the same request, which e supersedes
+func (j *journal) commit(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+	for _, old := range entries {
+		if old.igoRequestID == e.igoRequestID && old.seq <= e.seq {
+			if err := os.Remove(old.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quarantine renames e and any older entries of the same request, which it supersedes, so they
+// are no longer pending. the files are kept for inspection.
+func (j *journal) quarantine(e journalEntry) error {
+	entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+	for _, old := range entries {
+		if old.igoRequestID == e.igoRequestID && old.seq <= e.seq {
+			if err := os.Rename(old.path, old.path+quarantineExt); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pending returns the newest entry of every request left in the journal, oldest first
+func (j *journal) pending() ([]journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	entries, err := j.entries()
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int)
+	var pending []journalEntry
+	for _, e := range entries {
+		if i, ok := latest[e.igoRequestID]; ok {
+			pending[i] = e
+			continue
+		}
+		latest[e.igoRequestID] = len(pending)
+		pending = append(pending, e)
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].seq < pending[b].seq })
+	return pending, nil
+}
+
+// request reads the request recorded by e
+func (e journalEntry) request() (smile.Request, error) {
+	var sr smile.Request
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return sr, err
+	}
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return sr, fmt.Errorf("%w %s: %s", errCorruptEntry, filepath.Base(e.path), err)
+	}
+	return sr, nil
+}
+
+// entries lists the entries of the journal in sequence order
+func (j *journal) entries() ([]journalEntry, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalEntry
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, journalExt) {
+			continue
+		}
+		seqStr, idHex, ok := strings.Cut(strings.TrimSuffix(name, journalExt), "_")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseInt(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		id, err := hex.DecodeString(idHex)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, journalEntry{path: filepath.Join(j.dir, name), seq: seq, igoRequestID: string(id)})
+	}
+	// names are zero padded so they sort by sequence
+	return entries, nil
+}
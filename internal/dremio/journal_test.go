@@ -0,0 +1,127 @@
+package dremio
+
+import (
+	"errors"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func pendingIDs(t *testing.T, j *journal) []string {
+	t.Helper()
+	pending, err := j.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, e := range pending {
+		sr, err := e.request()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, sr.IgoRequestID+":"+sr.GenePanel)
+	}
+	return ids
+}
+
+func TestJournal(t *testing.T) {
+	j, err := openJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := func(id, version string) journalEntry {
+		t.Helper()
+		e, err := j.begin(smile.Request{IgoRequestID: id, GenePanel: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	a1 := begin("22022_A", "v1")
+	begin("22022_B/../x", "v1")
+	a2 := begin("22022_A", "v2")
+
+	// only the newest version of a request is recovered
+	if got := pendingIDs(t, j); len(got) != 2 || got[0] != "22022_B/../x:v1" || got[1] != "22022_A:v2" {
+		t.Fatalf("pending = %v, want [22022_B/../x:v1 22022_A:v2]", got)
+	}
+	// committing an older version keeps the newer one
+	if err := j.commit(a1); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(t, j); len(got) != 2 {
+		t.Fatalf("pending = %v after committing the older version, want 2 entries", got)
+	}
+	a3 := begin("22022_A", "v3")
+	// committing a newer version supersedes the older ones
+	if err := j.commit(a2); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(t, j); len(got) != 2 || got[1] != "22022_A:v3" {
+		t.Fatalf("pending = %v, want v3 of 22022_A to be left", got)
+	}
+	if err := j.commit(a3); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(t, j); len(got) != 1 || got[0] != "22022_B/../x:v1" {
+		t.Fatalf("pending = %v, want [22022_B/../x:v1]", got)
+	}
+
+	// no temporary files are left behind
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("journal directory holds %d files, want 1", len(files))
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *journal
+	e, err := j.begin(smile.Request{IgoRequestID: "22022_A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.commit(e); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := j.pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("pending = %v, %v, want nothing", pending, err)
+	}
+}
+
+func TestJournalQuarantine(t *testing.T) {
+	j, err := openJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.begin(smile.Request{IgoRequestID: "22022_A", GenePanel: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.begin(smile.Request{IgoRequestID: "22022_B", GenePanel: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := j.begin(smile.Request{IgoRequestID: "22022_A", GenePanel: "v2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(e.path, []byte(`{"igoRequestId":"22022_A","gen`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.request(); !errors.Is(err, errCorruptEntry) {
+		t.Fatalf("request returned %v, want %v", err, errCorruptEntry)
+	}
+
+	// the older version it supersedes goes along with it
+	if err := j.quarantine(e); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingIDs(t, j); len(got) != 1 || got[0] != "22022_B:v1" {
+		t.Fatalf("pending = %v, want [22022_B:v1]", got)
+	}
+	if _, err := os.Stat(e.path + quarantineExt); err != nil {
+		t.Errorf("quarantined entry is gone: %s", err)
+	}
+}
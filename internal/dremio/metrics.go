@@ -0,0 +1,24 @@
+package dremio
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var statementDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "dremio_gateway",
+	Name:      "statement_duration_seconds",
+	Help:      "Latency of statements issued against dremio by kind and result.",
+	// dml on dremio tables takes anywhere from tens of milliseconds to minutes
+	Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+}, []string{"statement", "result"})
+
+// observeStatement records the latency of a statement of the given kind that started at start
+func observeStatement(kind string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	statementDuration.WithLabelValues(kind, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,325 @@
+package dremio
+
+import (
+	"context"
+	"fmt"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"strings"
+	"time"
+)
+
+const defaultMigrationTable = "schema_migrations"
+
+// migration is a versioned change to the schema of the tables. migrations are applied in order
+// and never edited once released, any later change to the schema is a new migration.
+type migration struct {
+	version     int
+	description string
+	// statements returns the ddl of the migration for the tables of r
+	statements func(r *DremioRepository) []string
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create request and sample tables",
+		statements: func(r *DremioRepository) []string {
+			return []string{
+				createTableStmt(r.requestTable, varchars("IGO_REQUEST_ID", "REQUEST_JSON")),
+				createTableStmt(r.sampleTable, varchars("IGO_REQUEST_ID", "IGO_SAMPLE_NAME", "CMO_SAMPLE_NAME", "CFDNA2DBARCODE", "CMO_PATIENT_ID", "SAMPLE_JSON")),
+			}
+		},
+	},
+}
+
+// migrationColumns is the layout of the table recording the applied migrations
+var migrationColumns = []columnDef{{"VERSION", "INT"}, {"DESCRIPTION", "VARCHAR"}, {"APPLIED_AT", "TIMESTAMP"}}
+
+// tableDef is the layout a table is expected to have once all migrations are applied
+type tableDef struct {
+	// name of the table under args.ObjectStore and its quoted path
+	name    string
+	path    string
+	columns []columnDef
+}
+
+// tables returns the columns the tables written by the repository are expected to have
+func (r *DremioRepository) tables() []tableDef {
+	var samples []columnDef
+	samples = append(samples, sampleSchema...)
+	samples = append(samples, r.sampleColumnDefs()...)
+	tables := []tableDef{
+		{r.args.RequestTable, r.requestTable, requestSchema},
+		{r.args.SampleTable, r.sampleTable, samples},
+	}
+	return append(tables, r.optionalTables()...)
+}
+
+// optionalTables returns the tables written only when they are configured. they are created
+// according to the configuration by Migrate rather than by a migration.
+func (r *DremioRepository) optionalTables() []tableDef {
+	var tables []tableDef
+	for _, t := range r.children {
+		tables = append(tables, tableDef{t.name, t.path, t.columns})
+	}
+	if r.patientTable != "" {
+		tables = append(tables, tableDef{r.args.PatientTable, r.patientTable, patientColumns})
+	}
+	if r.patientAliasTable != "" {
+		tables = append(tables, tableDef{r.args.PatientAliasTable, r.patientAliasTable, patientAliasColumns})
+	}
+	return tables
+}
+
+// Migrate brings the tables up to date: it creates the ObjectStore folder if args.CreateFolder
+// is set, applies the migrations not applied yet in order, creates the enabled optional tables, adds
+// and backfills the columns of args.SampleColumns, creates or replaces the configured views and
+// validates the resulting schema.
+// migrations are not locked against each other, only one Migrate should run at a time.
+func (r *DremioRepository) Migrate(ctx context.Context) error {
+	return r.retry(ctx, func() error {
+		return r.withClient(ctx, func(af *arrowflight.ArrowFlight) error {
+			return r.migrate(ctx, af)
+		})
+	})
+}
+
+func (r *DremioRepository) migrate(ctx context.Context, af *arrowflight.ArrowFlight) error {
+	logger := logging.FromContext(ctx)
+	if r.args.CreateFolder {
+		folder, err := folderPath(r.args.ObjectStore)
+		if err != nil {
+			return err
+		}
+		if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, createFolderStmt(folder)); err != nil {
+			return fmt.Errorf("cannot create folder %s: %w", folder, err)
+		}
+	}
+	if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, createTableStmt(r.migrationTable, migrationColumns)); err != nil {
+		return fmt.Errorf("cannot create migration table: %w", err)
+	}
+	applied, err := r.appliedMigrations(ctx, af)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		logger.Info("Applying migration", "version", m.version, "description", m.description)
+		for _, stmt := range m.statements(r) {
+			if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, stmt); err != nil {
+				return fmt.Errorf("migration %d failed: %w", m.version, err)
+			}
+		}
+		query := insertStmt(r.migrationTable, columnNames(migrationColumns), []interface{}{m.version, m.description, time.Now()})
+		if _, err := r.exec(ctx, af, "record_migration", arrowflight.OpInsert, query); err != nil {
+			return fmt.Errorf("cannot record migration %d: %w", m.version, err)
+		}
+	}
+	for _, t := range r.optionalTables() {
+		if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, createTableStmt(t.path, t.columns)); err != nil {
+			return fmt.Errorf("cannot create table %s: %w", t.name, err)
+		}
+	}
+	if err := r.syncSampleColumns(ctx, af); err != nil {
+		return err
+	}
+	// views may select the mapped sample columns, so they come after them
+	if err := r.createViews(ctx, af); err != nil {
+		return err
+	}
+	return r.checkSchema(ctx, af)
+}
+
+// syncSampleColumns adds the columns of args.SampleColumns missing from the sample table and,
+// if args.BackfillSampleColumns is set, populates them from the SAMPLE_JSON of the stored samples.
+// the mapping is configuration rather than a migration, columns that are no longer mapped are left in place.
+func (r *DremioRepository) syncSampleColumns(ctx context.Context, af *arrowflight.ArrowFlight) error {
+	if len(r.args.SampleColumns) == 0 {
+		return nil
+	}
+	live, err := r.liveColumns(ctx, af, r.args.SampleTable)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(live))
+	for _, c := range live {
+		have[strings.ToUpper(c.name)] = true
+	}
+	var missing []columnDef
+	for _, c := range r.sampleColumnDefs() {
+		if !have[strings.ToUpper(c.name)] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		logging.FromContext(ctx).Info("Adding sample columns", "columns", columnNames(missing))
+		if _, err := r.exec(ctx, af, "migrate", arrowflight.OpUpdate, addColumnsStmt(r.sampleTable, missing)); err != nil {
+			return fmt.Errorf("cannot add sample columns: %w", err)
+		}
+	}
+	if !r.args.BackfillSampleColumns {
+		if len(missing) > 0 {
+			logging.FromContext(ctx).Warn("Stored samples keep the added columns unset, migrate with backfill enabled to populate them")
+		}
+		return nil
+	}
+	// only rows with unset columns are touched, so a backfill cut short is completed by the next run
+	n, err := r.exec(ctx, af, "backfill_samples", arrowflight.OpUpdate, backfillStmt(r.sampleTable, r.args.SampleColumns))
+	if err != nil {
+		return fmt.Errorf("cannot backfill sample columns: %w", err)
+	}
+	logging.FromContext(ctx).Info("Backfilled sample columns", "rows", n)
+	return nil
+}
+
+// CheckSchema verifies that all migrations have been applied and that the tables have the
+// expected columns with the expected types.
+func (r *DremioRepository) CheckSchema(ctx context.Context) error {
+	return r.retry(ctx, func() error {
+		return r.withClient(ctx, func(af *arrowflight.ArrowFlight) error {
+			return r.checkSchema(ctx, af)
+		})
+	})
+}
+
+func (r *DremioRepository) checkSchema(ctx context.Context, af *arrowflight.ArrowFlight) error {
+	applied, err := r.appliedMigrations(ctx, af)
+	if err != nil {
+		return fmt.Errorf("cannot read applied migrations, run migrate: %w", err)
+	}
+	for _, m := range migrations {
+		if !applied[m.version] {
+			return fmt.Errorf("migration %d (%s) has not been applied, run migrate", m.version, m.description)
+		}
+	}
+	for _, t := range r.tables() {
+		live, err := r.liveColumns(ctx, af, t.name)
+		if err != nil {
+			return err
+		}
+		if len(live) == 0 {
+			return fmt.Errorf("table %s does not exist, run migrate", t.name)
+		}
+		if err := compareColumns(t, live); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedMigrations returns the versions recorded in the migration table
+func (r *DremioRepository) appliedMigrations(ctx context.Context, af *arrowflight.ArrowFlight) (map[int]bool, error) {
+	applied := make(map[int]bool)
+	query := fmt.Sprintf("select VERSION from %s", r.migrationTable)
+	err := r.query(ctx, af, "select_migrations", query, func(rec array.Record) error {
+		if rec.NumRows() == 0 {
+			return nil
+		}
+		switch col := rec.Column(0).(type) {
+		case *array.Int32:
+			for i := 0; i < col.Len(); i++ {
+				applied[int(col.Value(i))] = true
+			}
+		case *array.Int64:
+			for i := 0; i < col.Len(); i++ {
+				applied[int(col.Value(i))] = true
+			}
+		default:
+			return fmt.Errorf("unexpected type of migration versions: %s", col.DataType())
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// liveColumns returns the columns of table as listed by INFORMATION_SCHEMA, none if it does not exist
+func (r *DremioRepository) liveColumns(ctx context.Context, af *arrowflight.ArrowFlight, table string) ([]columnDef, error) {
+	schema, name, err := infoSchemaName(r.args.ObjectStore, table)
+	if err != nil {
+		return nil, err
+	}
+	var cols []columnDef
+	err = r.query(ctx, af, "check_schema", columnsStmt(schema, name), func(rec array.Record) error {
+		if rec.NumCols() < 2 {
+			return fmt.Errorf("unexpected columns listing table %s", table)
+		}
+		names, ok1 := rec.Column(0).(*array.String)
+		types, ok2 := rec.Column(1).(*array.String)
+		if !ok1 || !ok2 {
+			return fmt.Errorf("unexpected columns listing table %s", table)
+		}
+		for i := 0; i < names.Len(); i++ {
+			cols = append(cols, columnDef{names.Value(i), types.Value(i)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read columns of table %s: %w", table, err)
+	}
+	return cols, nil
+}
+
+// compareColumns checks that every column of t is among the live ones listed by INFORMATION_SCHEMA,
+// with the expected type. writes name their columns, so neither the order of the columns nor
+// additional ones matter.
+func compareColumns(t tableDef, live []columnDef) error {
+	types := make(map[string]string, len(live))
+	for _, c := range live {
+		types[strings.ToUpper(c.name)] = c.typ
+	}
+	var missing []columnDef
+	for _, c := range t.columns {
+		typ, ok := types[strings.ToUpper(c.name)]
+		if !ok {
+			missing = append(missing, c)
+			continue
+		}
+		if !strings.EqualFold(infoSchemaType(c.typ), typ) {
+			return fmt.Errorf("column %s of table %s is %s, want %s", c.name, t.name, typ, c.typ)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("table %s is missing columns (%s), run migrate", t.name, formatColumns(missing))
+	}
+	return nil
+}
+
+// infoSchemaType returns typ the way INFORMATION_SCHEMA spells it, such as CHARACTER VARYING for VARCHAR
+func infoSchemaType(typ string) string {
+	switch strings.ToUpper(typ) {
+	case "VARCHAR":
+		return "CHARACTER VARYING"
+	case "INT":
+		return "INTEGER"
+	}
+	return typ
+}
+
+func formatColumns(cols []columnDef) string {
+	s := make([]string, len(cols))
+	for i, c := range cols {
+		s[i] = c.name + " " + c.typ
+	}
+	return strings.Join(s, ", ")
+}
+
+// varchars returns VARCHAR columns with the given names
+func varchars(names ...string) []columnDef {
+	cols := make([]columnDef, len(names))
+	for i, name := range names {
+		cols[i] = columnDef{name, "VARCHAR"}
+	}
+	return cols
+}
+
+func columnNames(cols []columnDef) []string {
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.name
+	}
+	return names
+}
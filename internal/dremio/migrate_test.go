@@ -0,0 +1,253 @@
+package dremio_test
+
+import (
+	"context"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight/flighttest"
+	"github.com/mskcc/smile-dremio-gateway/internal/dremio"
+	"google.golang.org/grpc/codes"
+	"strings"
+	"testing"
+)
+
+const migrationTable = `"local-minio"."smile"."schema_migrations"`
+
+// expected layout of the tables as listed by INFORMATION_SCHEMA, "NAME TYPE"
+var (
+	requestLayout = []string{"IGO_REQUEST_ID CHARACTER VARYING", "REQUEST_JSON CHARACTER VARYING"}
+	// the sample table as created by the first migration
+	baseSampleLayout = []string{"IGO_REQUEST_ID CHARACTER VARYING", "IGO_SAMPLE_NAME CHARACTER VARYING", "CMO_SAMPLE_NAME CHARACTER VARYING",
+		"CFDNA2DBARCODE CHARACTER VARYING", "CMO_PATIENT_ID CHARACTER VARYING", "SAMPLE_JSON CHARACTER VARYING"}
+	// followed by the default sample columns
+	sampleLayout = append(baseSampleLayout[:len(baseSampleLayout):len(baseSampleLayout)],
+		"SMILE_SAMPLE_ID CHARACTER VARYING", "SMILE_PATIENT_ID CHARACTER VARYING", "ONCOTREE_CODE CHARACTER VARYING",
+		"SAMPLE_TYPE CHARACTER VARYING", "TUMOR_OR_NORMAL CHARACTER VARYING", "SAMPLE_CLASS CHARACTER VARYING",
+		"BAIT_SET CHARACTER VARYING", "GENE_PANEL CHARACTER VARYING", "SPECIES CHARACTER VARYING", "SEX CHARACTER VARYING",
+		"IGO_COMPLETE BOOLEAN")
+)
+
+const (
+	addSampleColumns = "alter table " + sampleTable + " add columns (SMILE_SAMPLE_ID VARCHAR, SMILE_PATIENT_ID VARCHAR, ONCOTREE_CODE VARCHAR," +
+		" SAMPLE_TYPE VARCHAR, TUMOR_OR_NORMAL VARCHAR, SAMPLE_CLASS VARCHAR, BAIT_SET VARCHAR, GENE_PANEL VARCHAR, SPECIES VARCHAR," +
+		" SEX VARCHAR, IGO_COMPLETE BOOLEAN)"
+	backfillSamples = "update " + sampleTable + " set SMILE_SAMPLE_ID = nullif(cast(convert_from(SAMPLE_JSON, 'JSON')['smileSampleId'] as VARCHAR), '00000000-0000-0000-0000-000000000000')," +
+		" SMILE_PATIENT_ID = nullif(cast(convert_from(SAMPLE_JSON, 'JSON')['smilePatientId'] as VARCHAR), '00000000-0000-0000-0000-000000000000')," +
+		" ONCOTREE_CODE = cast(convert_from(SAMPLE_JSON, 'JSON')['oncotreeCode'] as VARCHAR)," +
+		" SAMPLE_TYPE = cast(convert_from(SAMPLE_JSON, 'JSON')['sampleType'] as VARCHAR)," +
+		" TUMOR_OR_NORMAL = cast(convert_from(SAMPLE_JSON, 'JSON')['tumorOrNormal'] as VARCHAR)," +
+		" SAMPLE_CLASS = cast(convert_from(SAMPLE_JSON, 'JSON')['sampleClass'] as VARCHAR)," +
+		" BAIT_SET = cast(convert_from(SAMPLE_JSON, 'JSON')['baitSet'] as VARCHAR)," +
+		" GENE_PANEL = cast(convert_from(SAMPLE_JSON, 'JSON')['genePanel'] as VARCHAR)," +
+		" SPECIES = cast(convert_from(SAMPLE_JSON, 'JSON')['species'] as VARCHAR)," +
+		" SEX = cast(convert_from(SAMPLE_JSON, 'JSON')['sex'] as VARCHAR)," +
+		" IGO_COMPLETE = cast(convert_from(SAMPLE_JSON, 'JSON')['igoComplete'] as BOOLEAN)" +
+		" where (SMILE_SAMPLE_ID is null and nullif(cast(convert_from(SAMPLE_JSON, 'JSON')['smileSampleId'] as VARCHAR), '00000000-0000-0000-0000-000000000000') is not null)" +
+		" or (SMILE_PATIENT_ID is null and nullif(cast(convert_from(SAMPLE_JSON, 'JSON')['smilePatientId'] as VARCHAR), '00000000-0000-0000-0000-000000000000') is not null)" +
+		" or (ONCOTREE_CODE is null and cast(convert_from(SAMPLE_JSON, 'JSON')['oncotreeCode'] as VARCHAR) is not null)" +
+		" or (SAMPLE_TYPE is null and cast(convert_from(SAMPLE_JSON, 'JSON')['sampleType'] as VARCHAR) is not null)" +
+		" or (TUMOR_OR_NORMAL is null and cast(convert_from(SAMPLE_JSON, 'JSON')['tumorOrNormal'] as VARCHAR) is not null)" +
+		" or (SAMPLE_CLASS is null and cast(convert_from(SAMPLE_JSON, 'JSON')['sampleClass'] as VARCHAR) is not null)" +
+		" or (BAIT_SET is null and cast(convert_from(SAMPLE_JSON, 'JSON')['baitSet'] as VARCHAR) is not null)" +
+		" or (GENE_PANEL is null and cast(convert_from(SAMPLE_JSON, 'JSON')['genePanel'] as VARCHAR) is not null)" +
+		" or (SPECIES is null and cast(convert_from(SAMPLE_JSON, 'JSON')['species'] as VARCHAR) is not null)" +
+		" or (SEX is null and cast(convert_from(SAMPLE_JSON, 'JSON')['sex'] as VARCHAR) is not null)" +
+		" or (IGO_COMPLETE is null and cast(convert_from(SAMPLE_JSON, 'JSON')['igoComplete'] as BOOLEAN) is not null)"
+)
+
+func columnsQuery(table string) string {
+	return `select COLUMN_NAME, DATA_TYPE from INFORMATION_SCHEMA."COLUMNS" where TABLE_SCHEMA = 'local-minio.smile' and TABLE_NAME = '` +
+		table + `' order by ORDINAL_POSITION`
+}
+
+// columnsResult answers an INFORMATION_SCHEMA column listing with layout
+func columnsResult(layout ...string) flighttest.Result {
+	rows := make([][]interface{}, len(layout))
+	for i, c := range layout {
+		name, typ, _ := strings.Cut(c, " ")
+		rows[i] = []interface{}{name, typ}
+	}
+	return flighttest.Rows([]string{"COLUMN_NAME", "DATA_TYPE"}, rows...)
+}
+
+// versionsResult answers the query of the applied migrations
+func versionsResult(versions ...int32) flighttest.Result {
+	rows := make([][]interface{}, len(versions))
+	for i, v := range versions {
+		rows[i] = []interface{}{v}
+	}
+	return flighttest.Rows([]string{"VERSION"}, rows...)
+}
+
+// respondSchema scripts INFORMATION_SCHEMA to list the tables with the expected layout
+func respondSchema(fs *flighttest.Server) {
+	fs.Respond(columnsQuery("requests"), columnsResult(requestLayout...))
+	fs.Respond(columnsQuery("samples"), columnsResult(sampleLayout...))
+}
+
+func TestMigrate(t *testing.T) {
+	args := dArgs
+	args.CreateFolder = true
+	args.BackfillSampleColumns = true
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select VERSION", versionsResult(), versionsResult(1))
+	fs.Respond(columnsQuery("requests"), columnsResult(requestLayout...))
+	fs.Respond(columnsQuery("samples"), columnsResult(baseSampleLayout...), columnsResult(sampleLayout...))
+
+	if err := dr.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`create folder if not exists "local-minio"."smile"`,
+		"create table if not exists " + migrationTable + " (VERSION INT, DESCRIPTION VARCHAR, APPLIED_AT TIMESTAMP)",
+		"select VERSION from " + migrationTable,
+		"create table if not exists " + requestTable + " (IGO_REQUEST_ID VARCHAR, REQUEST_JSON VARCHAR)",
+		"create table if not exists " + sampleTable + " (IGO_REQUEST_ID VARCHAR, IGO_SAMPLE_NAME VARCHAR, CMO_SAMPLE_NAME VARCHAR, CFDNA2DBARCODE VARCHAR, CMO_PATIENT_ID VARCHAR, SAMPLE_JSON VARCHAR)",
+		// followed by the time it was applied
+		"insert into " + migrationTable + " (VERSION, DESCRIPTION, APPLIED_AT) values (1, 'create request and sample tables', TIMESTAMP '",
+		columnsQuery("samples"),
+		addSampleColumns,
+		backfillSamples,
+		"select VERSION from " + migrationTable,
+		columnsQuery("requests"),
+		columnsQuery("samples"),
+	}
+	got := fs.Statements()
+	if len(got) != len(want) {
+		t.Fatalf("got %d statements, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("statement %d:\ngot  %s\nwant %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMigrateSkipsAppliedMigrations(t *testing.T) {
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select VERSION", versionsResult(1))
+	respondSchema(fs)
+
+	if err := dr.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, []string{
+		"create table if not exists " + migrationTable + " (VERSION INT, DESCRIPTION VARCHAR, APPLIED_AT TIMESTAMP)",
+		"select VERSION from " + migrationTable,
+		// the columns are there, rows stored by an older version are only backfilled on request
+		columnsQuery("samples"),
+		"select VERSION from " + migrationTable,
+		columnsQuery("requests"),
+		columnsQuery("samples"),
+	})
+}
+
+func TestMigrateSampleColumns(t *testing.T) {
+	args := dArgs
+	args.SampleColumns = []dremio.SampleColumn{{"ONCOTREE_CODE", "oncotreeCode"}, {"TUBE_ID", "tubeId"}}
+	args.BackfillSampleColumns = true
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select VERSION", versionsResult(1))
+	// a column that is no longer mapped is left alone
+	live := append(baseSampleLayout[:len(baseSampleLayout):len(baseSampleLayout)], "ONCOTREE_CODE CHARACTER VARYING", "SEX CHARACTER VARYING")
+	fs.Respond(columnsQuery("samples"), columnsResult(live...), columnsResult(append(live, "TUBE_ID CHARACTER VARYING")...))
+	fs.Respond(columnsQuery("requests"), columnsResult(requestLayout...))
+
+	if err := dr.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, []string{
+		"create table if not exists " + migrationTable + " (VERSION INT, DESCRIPTION VARCHAR, APPLIED_AT TIMESTAMP)",
+		"select VERSION from " + migrationTable,
+		columnsQuery("samples"),
+		"alter table " + sampleTable + " add columns (TUBE_ID VARCHAR)",
+		"update " + sampleTable + " set ONCOTREE_CODE = cast(convert_from(SAMPLE_JSON, 'JSON')['oncotreeCode'] as VARCHAR)," +
+			" TUBE_ID = cast(convert_from(SAMPLE_JSON, 'JSON')['tubeId'] as VARCHAR) where (ONCOTREE_CODE is null and cast(convert_from(SAMPLE_JSON, 'JSON')['oncotreeCode'] as VARCHAR) is not null)" +
+			" or (TUBE_ID is null and cast(convert_from(SAMPLE_JSON, 'JSON')['tubeId'] as VARCHAR) is not null)",
+		"select VERSION from " + migrationTable,
+		columnsQuery("requests"),
+		columnsQuery("samples"),
+	})
+}
+
+func TestNewDremioReposRejectsSampleColumns(t *testing.T) {
+	tests := []struct {
+		name string
+		cols []dremio.SampleColumn
+	}{
+		{"unknown field", []dremio.SampleColumn{{"LIBRARIES", "libraries"}}},
+		{"not an identifier", []dremio.SampleColumn{{"ONCOTREE CODE; drop table x", "oncotreeCode"}}},
+		{"duplicate", []dremio.SampleColumn{{"SEX", "sex"}, {"sex", "species"}}},
+		{"clashes with the base columns", []dremio.SampleColumn{{"SAMPLE_JSON", "sex"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := dArgs
+			args.Host, args.Username, args.Password = "localhost", flighttest.Username, flighttest.Password
+			args.SampleColumns = tt.cols
+			if _, err := dremio.NewDremioRepos(args); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestMigrateStopsOnFailure(t *testing.T) {
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select VERSION", versionsResult())
+	fs.Respond("create table if not exists "+sampleTable, flighttest.Error(codes.PermissionDenied, "no create privilege"))
+
+	if err := dr.Migrate(context.Background()); err == nil || !strings.Contains(err.Error(), "migration 1 failed") {
+		t.Fatalf("Migrate returned %v, want migration 1 to fail", err)
+	}
+	// the migration is not recorded so it is applied again by the next run
+	for _, stmt := range fs.Statements() {
+		if strings.HasPrefix(stmt, "insert into "+migrationTable) {
+			t.Errorf("failed migration was recorded: %s", stmt)
+		}
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions flighttest.Result
+		requests []string
+		samples  []string
+		// substring of the error, empty when the schema is up to date
+		wantErr string
+	}{
+		{"up to date", versionsResult(1), requestLayout, sampleLayout, ""},
+		{"versions as bigint", flighttest.Rows([]string{"VERSION"}, []interface{}{int64(1)}), requestLayout, sampleLayout, ""},
+		{"never migrated", flighttest.Error(codes.InvalidArgument, "Table 'schema_migrations' not found"), nil, nil, "run migrate"},
+		{"migration pending", versionsResult(), requestLayout, sampleLayout, "migration 1 (create request and sample tables) has not been applied"},
+		{"missing table", versionsResult(1), requestLayout, nil, "table samples does not exist"},
+		{"missing column", versionsResult(1), requestLayout[:1], sampleLayout, "table requests is missing columns (REQUEST_JSON VARCHAR), run migrate"},
+		{"sample columns not added", versionsResult(1), requestLayout, baseSampleLayout, "table samples is missing columns (SMILE_SAMPLE_ID VARCHAR"},
+		{"wrong type", versionsResult(1), []string{"IGO_REQUEST_ID CHARACTER VARYING", "REQUEST_JSON INTEGER"}, sampleLayout, "column REQUEST_JSON of table requests is INTEGER, want VARCHAR"},
+		// writes name their columns, so their order and additional columns do not matter
+		{"other order", versionsResult(1), requestLayout, append([]string{sampleLayout[1], sampleLayout[0]}, sampleLayout[2:]...), ""},
+		{"additional columns", versionsResult(1), append(requestLayout[:2:2], "NOTES CHARACTER VARYING"), sampleLayout, ""},
+		{"lower case names", versionsResult(1), []string{"igo_request_id character varying", "request_json character varying"}, sampleLayout, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, dr := newTestRepos(t, dArgs)
+			fs.Respond("select VERSION", tt.versions)
+			fs.Respond(columnsQuery("requests"), columnsResult(tt.requests...))
+			fs.Respond(columnsQuery("samples"), columnsResult(tt.samples...))
+
+			err := dr.CheckSchema(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckSchema returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if dremio.IsTransient(err) {
+				t.Errorf("CheckSchema returned a transient error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package dremio
+
+import (
+	"context"
+	"fmt"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+)
+
+// columns of the optional patient tables. PATIENTS has a row per SMILE_PATIENT_ID holding the
+// CMO_PATIENT_ID it currently has, PATIENT_ALIASES a row per alias of a patient.
+var (
+	patientColumns      = varchars("SMILE_PATIENT_ID", "CMO_PATIENT_ID")
+	patientAliasColumns = varchars("SMILE_PATIENT_ID", "NAMESPACE", "ALIAS_VALUE")
+)
+
+// patientRows returns the patient and alias rows of the patients of samples along with their
+// ids. a patient of several samples is written once, as described by the first of them.
+// samples without a SmilePatientID have no patient to key the rows on and are skipped.
+func patientRows(samples ...smile.Sample) (ids []interface{}, patients, aliases [][]interface{}) {
+	seen := make(map[uuid.UUID]bool)
+	for _, s := range samples {
+		if s.SmilePatientID == uuid.Nil || seen[s.SmilePatientID] {
+			continue
+		}
+		seen[s.SmilePatientID] = true
+		ids = append(ids, s.SmilePatientID)
+		patients = append(patients, []interface{}{s.SmilePatientID, s.CmoPatientID})
+		for _, a := range s.PatientAliases {
+			aliases = append(aliases, []interface{}{s.SmilePatientID, a.Namespace, a.Value})
+		}
+	}
+	return ids, patients, aliases
+}
+
+// upsertPatients writes the patients of samples to the enabled patient tables, replacing the
+// stored rows of the same patients. patients are merged when args.AddStrategy is AddMerge and
+// deleted and inserted otherwise, their aliases are always replaced as a whole.
+func (r *DremioRepository) upsertPatients(ctx context.Context, af *arrowflight.ArrowFlight, samples ...smile.Sample) error {
+	ids, patients, aliases := patientRows(samples...)
+	if len(ids) == 0 {
+		return nil
+	}
+	if r.patientTable != "" {
+		if r.args.AddStrategy == AddMerge {
+			for _, c := range r.batches(patients) {
+				query := mergeStmt(r.patientTable, columnNames(patientColumns), []string{"SMILE_PATIENT_ID"}, patients[c[0]:c[1]]...)
+				if _, err := r.exec(ctx, af, "merge_patients", arrowflight.OpInsert, query); err != nil {
+					return err
+				}
+			}
+		} else if err := r.replaceRows(ctx, af, "patients", r.patientTable, patientColumns, ids, patients); err != nil {
+			return err
+		}
+	}
+	if r.patientAliasTable != "" {
+		return r.replaceRows(ctx, af, "patient_aliases", r.patientAliasTable, patientAliasColumns, ids, aliases)
+	}
+	return nil
+}
+
+// replaceRows deletes the rows of tbl of the patients ids and inserts rows in batches
+func (r *DremioRepository) replaceRows(ctx context.Context, af *arrowflight.ArrowFlight, kind, tbl string, cols []columnDef, ids []interface{}, rows [][]interface{}) error {
+	if _, err := r.exec(ctx, af, "delete_"+kind, arrowflight.OpDelete, deleteInStmt(tbl, "SMILE_PATIENT_ID", ids)); err != nil {
+		return err
+	}
+	for _, c := range r.batches(rows) {
+		if _, err := r.exec(ctx, af, "insert_"+kind, arrowflight.OpInsert, insertStmt(tbl, columnNames(cols), rows[c[0]:c[1]]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updatePatient replaces the patient of the stored sample old with that of s. a patient keeps
+// its row when its CmoPatientID changes, it is updated in place. when s moved to another patient,
+// the old one is removed once no sample refers to it anymore. this is the only place patients are
+// removed: AddRequest replaces the samples of a request without reading the stored ones, so it
+// does not know the patients they referred to, and those left without samples keep their rows.
+func (r *DremioRepository) updatePatient(ctx context.Context, af *arrowflight.ArrowFlight, old, s smile.Sample) error {
+	if r.patientTable == "" && r.patientAliasTable == "" {
+		return nil
+	}
+	if err := r.upsertPatients(ctx, af, s); err != nil {
+		return err
+	}
+	if old.SmilePatientID == uuid.Nil || old.SmilePatientID == s.SmilePatientID {
+		return nil
+	}
+	n, err := r.count(ctx, af, "count_patient_samples", countStmt(r.sampleTable, column{r.sampleFieldExpr("smilePatientId"), old.SmilePatientID}))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	logging.FromContext(ctx).Info("Removing patient without samples", "smilePatientId", old.SmilePatientID, "cmoPatientId", old.CmoPatientID)
+	return r.removePatient(ctx, af, old.SmilePatientID)
+}
+
+// sampleFieldExpr returns the expression reading the string field of a sample row, its mapped
+// column if there is one, its SAMPLE_JSON otherwise
+func (r *DremioRepository) sampleFieldExpr(field string) string {
+	for _, c := range r.args.SampleColumns {
+		if c.Field == field {
+			return c.Column
+		}
+	}
+	return fmt.Sprintf("cast(%s as VARCHAR)", jsonField(field))
+}
+
+// removePatient deletes the rows of patient id from the enabled patient tables
+func (r *DremioRepository) removePatient(ctx context.Context, af *arrowflight.ArrowFlight, id uuid.UUID) error {
+	if r.patientTable != "" {
+		if _, err := r.exec(ctx, af, "delete_patients", arrowflight.OpDelete, deleteStmt(r.patientTable, column{"SMILE_PATIENT_ID", id})); err != nil {
+			return err
+		}
+	}
+	if r.patientAliasTable != "" {
+		if _, err := r.exec(ctx, af, "delete_patient_aliases", arrowflight.OpDelete, deleteStmt(r.patientAliasTable, column{"SMILE_PATIENT_ID", id})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count runs a query answering a single count
+func (r *DremioRepository) count(ctx context.Context, af *arrowflight.ArrowFlight, kind string, query string) (int64, error) {
+	var n int64
+	found := false
+	err := r.query(ctx, af, kind, query, func(rec array.Record) error {
+		if rec.NumRows() == 0 {
+			return nil
+		}
+		col, ok := rec.Column(0).(*array.Int64)
+		if !ok {
+			return fmt.Errorf("unexpected type of count: %s", rec.Column(0).DataType())
+		}
+		n, found = col.Value(0), true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("count returned no rows: %s", query)
+	}
+	return n, nil
+}
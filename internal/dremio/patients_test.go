@@ -0,0 +1,172 @@
+package dremio_test
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight/flighttest"
+	"github.com/mskcc/smile-dremio-gateway/internal/dremio"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"strings"
+	"testing"
+)
+
+const (
+	patientTable      = `"local-minio"."smile"."patients"`
+	patientAliasTable = `"local-minio"."smile"."patient_aliases"`
+)
+
+// patientArgs enables the patient tables
+func patientArgs() dremio.DremioArgs {
+	args := dArgs
+	args.PatientTable, args.PatientAliasTable = "patients", "patient_aliases"
+	return args
+}
+
+// patientValues returns the patient ids, patient rows and alias rows of samples as sql
+func patientValues(samples ...smile.Sample) (ids, patients, aliases []string) {
+	for _, s := range samples {
+		id := literal(s.SmilePatientID.String())
+		ids = append(ids, id)
+		patients = append(patients, "("+id+", "+literal(s.CmoPatientID)+")")
+		for _, a := range s.PatientAliases {
+			aliases = append(aliases, "("+id+", "+literal(a.Namespace)+", "+literal(a.Value)+")")
+		}
+	}
+	return ids, patients, aliases
+}
+
+// patientReplace returns the statements replacing the rows of the patients of samples
+func patientReplace(samples ...smile.Sample) []string {
+	ids, patients, aliases := patientValues(samples...)
+	in := " where SMILE_PATIENT_ID in (" + strings.Join(ids, ", ") + ")"
+	return []string{
+		"delete from " + patientTable + in,
+		"insert into " + patientTable + " (SMILE_PATIENT_ID, CMO_PATIENT_ID) values " + strings.Join(patients, ", "),
+		"delete from " + patientAliasTable + in,
+		"insert into " + patientAliasTable + " (SMILE_PATIENT_ID, NAMESPACE, ALIAS_VALUE) values " + strings.Join(aliases, ", "),
+	}
+}
+
+func TestNewRequestPatients(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:2]
+	// a patient of several samples is written once
+	r.Samples = append(r.Samples, r.Samples[0])
+	r.Samples[2].SampleName = "LMNO_4396_T"
+	// a sample without a patient is skipped
+	r.Samples = append(r.Samples, r.Samples[1])
+	r.Samples[3].SampleName, r.Samples[3].SmilePatientID = "LMNO_4397_N", uuid.Nil
+	fs, dr := newTestRepos(t, patientArgs())
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	stmts := newRequestStatements(t, r)
+	want := append(stmts[:3:3], patientReplace(r.Samples[:2]...)...)
+	assertStatements(t, fs, append(want, stmts[3]))
+}
+
+func TestNewRequestMergePatients(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	args := patientArgs()
+	args.AddStrategy = dremio.AddMerge
+	args.PatientAliasTable = ""
+	fs, dr := newTestRepos(t, args)
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	got := fs.Statements()
+	_, patients, _ := patientValues(r.Samples...)
+	want := "merge into " + patientTable + " as t using (values " + patients[0] + ") as s(SMILE_PATIENT_ID, CMO_PATIENT_ID)" +
+		" on t.SMILE_PATIENT_ID = s.SMILE_PATIENT_ID when matched then update set CMO_PATIENT_ID = s.CMO_PATIENT_ID" +
+		" when not matched then insert (SMILE_PATIENT_ID, CMO_PATIENT_ID) values (s.SMILE_PATIENT_ID, s.CMO_PATIENT_ID)"
+	// merge samples, delete stale samples, merge patients, merge request
+	if len(got) != 4 || got[2] != want {
+		t.Errorf("got statements\n%s\nwant the patients to be merged before the request", strings.Join(got, "\n"))
+	}
+}
+
+func TestUpdateSamplePatients(t *testing.T) {
+	oldPatient := uuid.MustParse("6cc7394f-875a-11eb-91ec-acde48001122")
+	newPatient := uuid.MustParse("6cca3573-875a-11eb-911e-acde48001122")
+	removal := []string{
+		"delete from " + patientTable + " where SMILE_PATIENT_ID = '6cc7394f-875a-11eb-91ec-acde48001122'",
+		"delete from " + patientAliasTable + " where SMILE_PATIENT_ID = '6cc7394f-875a-11eb-91ec-acde48001122'",
+	}
+	count := "select count(*) from " + sampleTable + " where SMILE_PATIENT_ID = '6cc7394f-875a-11eb-91ec-acde48001122'"
+	jsonCount := "select count(*) from " + sampleTable +
+		" where cast(convert_from(SAMPLE_JSON, 'JSON')['smilePatientId'] as VARCHAR) = '6cc7394f-875a-11eb-91ec-acde48001122'"
+	tests := []struct {
+		name string
+		// patient and cmo patient id of the updated sample
+		patient      uuid.UUID
+		cmoPatientID string
+		// sample columns, the defaults when nil
+		columns []dremio.SampleColumn
+		// samples still referring to the old patient
+		remaining int64
+		want      []string
+	}{
+		{"same patient", oldPatient, "C-TX6DNG", nil, 0, nil},
+		// the patient row is updated in place
+		{"cmo patient id changed", oldPatient, "C-NEW001", nil, 0, nil},
+		{"moved with its cmo patient id, old patient has samples left", newPatient, "C-TX6DNG", nil, 1, []string{count}},
+		{"moved with its cmo patient id", newPatient, "C-TX6DNG", nil, 0, append([]string{count}, removal...)},
+		{"moved, old patient has samples left", newPatient, "C-NEW001", nil, 1, []string{count}},
+		{"moved, old patient has no samples left", newPatient, "C-NEW001", nil, 0, append([]string{count}, removal...)},
+		// without a mapped column the samples are counted by their SAMPLE_JSON
+		{"moved, patient id not mapped", newPatient, "C-NEW001", []dremio.SampleColumn{}, 1, []string{jsonCount}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s []smile.Sample
+			unmarshal(t, updatedSample, &s)
+			s[1].SmilePatientID = oldPatient
+			s[0].SmilePatientID, s[0].CmoPatientID = tt.patient, tt.cmoPatientID
+			args := patientArgs()
+			args.SampleColumns = tt.columns
+			fs, dr := newTestRepos(t, args)
+			fs.Respond("select count", flighttest.Rows([]string{"EXPR$0"}, []interface{}{tt.remaining}))
+
+			if err := dr.UpdateSample(context.Background(), s); err != nil {
+				t.Fatal(err)
+			}
+			got := fs.Statements()
+			want := append(patientReplace(s[0]), tt.want...)
+			if len(got) != len(want)+1 || !strings.HasPrefix(got[0], "update "+sampleTable) {
+				t.Fatalf("got statements\n%s\nwant the sample update followed by its patient", strings.Join(got, "\n"))
+			}
+			for i, stmt := range want {
+				if got[i+1] != stmt {
+					t.Errorf("statement %d:\ngot  %s\nwant %s", i+1, got[i+1], stmt)
+				}
+			}
+		})
+	}
+}
+
+func TestMigratePatientTables(t *testing.T) {
+	fs, dr := newTestRepos(t, patientArgs())
+	fs.Respond("select VERSION", versionsResult(1))
+	respondSchema(fs)
+	fs.Respond(columnsQuery("patients"), columnsResult("SMILE_PATIENT_ID CHARACTER VARYING", "CMO_PATIENT_ID CHARACTER VARYING"))
+	fs.Respond(columnsQuery("patient_aliases"), columnsResult("SMILE_PATIENT_ID CHARACTER VARYING", "NAMESPACE CHARACTER VARYING",
+		"ALIAS_VALUE CHARACTER VARYING"))
+
+	if err := dr.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got := fs.Statements()
+	want := []string{
+		"create table if not exists " + patientTable + " (SMILE_PATIENT_ID VARCHAR, CMO_PATIENT_ID VARCHAR)",
+		"create table if not exists " + patientAliasTable + " (SMILE_PATIENT_ID VARCHAR, NAMESPACE VARCHAR, ALIAS_VALUE VARCHAR)",
+	}
+	if len(got) < 2+len(want) || strings.Join(got[2:2+len(want)], "\n") != strings.Join(want, "\n") {
+		t.Errorf("got statements\n%s\nwant the patient tables to be created after the migrations", strings.Join(got, "\n"))
+	}
+}
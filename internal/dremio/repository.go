@@ -7,32 +7,131 @@ import (
 	"fmt"
 	"github.com/apache/arrow/go/arrow/array"
 	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
 	"github.com/mskcc/smile-dremio-gateway/internal/smile"
-	"strings"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	defaultPoolSize = 4
+	// dremio rejects statements longer than its configured query length limit
+	defaultInsertBatchRows  = 100
+	defaultInsertBatchBytes = 1 << 20
+)
+
+// supported values of DremioArgs.AddStrategy
+const (
+	// delete the stored request and samples, then insert the new ones
+	AddReplace = "replace"
+	// upsert samples and request with MERGE INTO, which requires iceberg tables. every statement
+	// changes a single table atomically, so readers never see a request without its samples.
+	AddMerge = "merge"
+)
+
+// supported values of DremioArgs.AuthMode
+const (
+	AuthBasic     = "basic"
+	AuthToken     = "pat"
+	AuthTokenFile = "tokenfile"
 )
 
 type DremioArgs struct {
-	Host         string
+	Host string
+	Port string
+	// one of AuthBasic (Username, Password), AuthToken (Token) or AuthTokenFile (TokenPath), defaults to AuthBasic
+	AuthMode     string
 	Username     string
 	Password     string
+	Token        string
+	TokenPath    string
 	ObjectStore  string
 	RequestTable string
 	SampleTable  string
+	// maximum number of simultaneous arrow flight clients, defaults to defaultPoolSize
+	PoolSize int
+	TLS      arrowflight.TLSArgs
+	// workload management routing, the per operation queues override RoutingQueue when set
+	RoutingTag   string
+	RoutingQueue string
+	LookupQueue  string
+	InsertQueue  string
+	UpdateQueue  string
+	DeleteQueue  string
+	// additional grpc headers sent to dremio with every call
+	Headers map[string]string
+	// upper bound on the time a single statement may take, no limit when zero
+	StatementTimeout time.Duration
+	// number of times an operation failing with a transient error is retried, defaults to
+	// defaultMaxRetries, a negative value disables retries
+	MaxRetries int
+	// AddReplace or AddMerge, defaults to AddReplace
+	AddStrategy string
+	// samples are written with multi row statements of at most InsertBatchRows rows whose values
+	// take at most InsertBatchBytes bytes, defaulting to defaultInsertBatchRows and defaultInsertBatchBytes
+	InsertBatchRows  int
+	InsertBatchBytes int
+	// typed sample table columns populated from the fields of every sample besides SAMPLE_JSON,
+	// defaults to DefaultSampleColumns when nil. Migrate adds the columns missing from the table.
+	SampleColumns []SampleColumn
+	// populate the unset sample columns of the stored samples from their SAMPLE_JSON when migrating.
+	// rows written since a column was added have it set already, only older rows need the backfill.
+	BackfillSampleColumns bool
+	// optional tables of the libraries, sequencing runs and fastq files of the samples, kept in
+	// sync with the sample table. a table is written when it is named, Migrate creates it.
+	LibraryTable string
+	RunTable     string
+	FastqTable   string
+	// optional tables of the sample aliases and qc reports of the samples, replaced whenever a sample is
+	// written like the tables above
+	SampleAliasTable string
+	QcReportTable    string
+	// optional views joining the sample alias and qc report tables to the samples, as dotted paths
+	// such as smile.sample_aliases. their table must be named, Migrate creates or replaces them.
+	SampleAliasView string
+	QcReportView    string
+	// optional tables holding a row per patient of the samples and the aliases of the patients by
+	// namespace, upserted whenever a sample is written. a table is written when it is named, Migrate creates it.
+	// a patient is removed when UpdateSample moves its last sample to another patient. AddRequest does not
+	// read the samples it replaces, so patients left without samples by it keep their rows.
+	PatientTable      string
+	PatientAliasTable string
+	// directory of the journal of adds in progress, which Recover completes after a crash.
+	// the journal is disabled when empty.
+	JournalDir string
+	// table under ObjectStore recording the applied schema migrations, defaults to defaultMigrationTable
+	MigrationTable string
+	// whether Migrate creates the ObjectStore folder, which is needed for spaces but not for sources
+	CreateFolder bool
+	// wait before the first retry, doubled on every subsequent retry up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
 }
 
 type DremioRepository struct {
 	args DremioArgs
+	pool *arrowflight.Pool
+	// single client of Ping, so readiness checks don't queue behind the workers for the pool
+	pingPool     *arrowflight.Pool
+	journal      *journal
+	requestTable string
+	sampleTable  string
+	// quoted path of args.MigrationTable
+	migrationTable string
+	children       []childTable
+	// quoted paths of the patient tables, empty when disabled
+	patientTable      string
+	patientAliasTable string
 }
 
 func NewDremioRepos(args DremioArgs) (*DremioRepository, error) {
 	if args.Host == "" {
 		return nil, errors.New("host must not be empty")
 	}
-	if args.Username == "" {
-		return nil, errors.New("username must not be empty")
-	}
-	if args.Password == "" {
-		return nil, errors.New("password must not be empty")
+	auth, err := newAuthenticator(args)
+	if err != nil {
+		return nil, err
 	}
 	if args.ObjectStore == "" {
 		return nil, errors.New("objectstore must not be empty")
@@ -43,62 +142,367 @@ func NewDremioRepos(args DremioArgs) (*DremioRepository, error) {
 	if args.SampleTable == "" {
 		return nil, errors.New("sampletable must not be empty")
 	}
-	return &DremioRepository{args: args}, nil
+	rt, err := tablePath(args.ObjectStore, args.RequestTable)
+	if err != nil {
+		return nil, err
+	}
+	st, err := tablePath(args.ObjectStore, args.SampleTable)
+	if err != nil {
+		return nil, err
+	}
+	if args.SampleColumns == nil {
+		args.SampleColumns = DefaultSampleColumns()
+	}
+	if err := validateSampleColumns(args.SampleColumns); err != nil {
+		return nil, err
+	}
+	if args.MigrationTable == "" {
+		args.MigrationTable = defaultMigrationTable
+	}
+	mt, err := tablePath(args.ObjectStore, args.MigrationTable)
+	if err != nil {
+		return nil, err
+	}
+	children, err := newChildTables(args)
+	if err != nil {
+		return nil, err
+	}
+	var pt, pat string
+	if args.PatientTable != "" {
+		if pt, err = tablePath(args.ObjectStore, args.PatientTable); err != nil {
+			return nil, err
+		}
+	}
+	if args.PatientAliasTable != "" {
+		if pat, err = tablePath(args.ObjectStore, args.PatientAliasTable); err != nil {
+			return nil, err
+		}
+	}
+	switch args.AddStrategy {
+	case "":
+		args.AddStrategy = AddReplace
+	case AddReplace, AddMerge:
+	default:
+		return nil, fmt.Errorf("unknown add strategy: %s", args.AddStrategy)
+	}
+	var j *journal
+	if args.JournalDir != "" {
+		if j, err = openJournal(args.JournalDir); err != nil {
+			return nil, err
+		}
+	}
+	if args.InsertBatchRows < 0 || args.InsertBatchBytes < 0 {
+		return nil, errors.New("insert batch limits must not be negative")
+	}
+	if args.InsertBatchRows == 0 {
+		args.InsertBatchRows = defaultInsertBatchRows
+	}
+	if args.InsertBatchBytes == 0 {
+		args.InsertBatchBytes = defaultInsertBatchBytes
+	}
+	if args.PoolSize == 0 {
+		args.PoolSize = defaultPoolSize
+	}
+	if args.MaxRetries == 0 {
+		args.MaxRetries = defaultMaxRetries
+	}
+	if args.RetryBackoff == 0 {
+		args.RetryBackoff = defaultRetryBackoff
+	}
+	if args.MaxRetryBackoff == 0 {
+		args.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	afArgs := arrowflight.ArrowFlightArgs{
+		Host:         args.Host,
+		Port:         args.Port,
+		Auth:         auth,
+		TLS:          args.TLS,
+		RoutingTag:   args.RoutingTag,
+		RoutingQueue: args.RoutingQueue,
+		Queues: map[arrowflight.Operation]string{
+			arrowflight.OpLookup: args.LookupQueue,
+			arrowflight.OpInsert: args.InsertQueue,
+			arrowflight.OpUpdate: args.UpdateQueue,
+			arrowflight.OpDelete: args.DeleteQueue,
+		},
+		Headers: args.Headers,
+	}
+	pool, err := arrowflight.NewPool(afArgs, args.PoolSize)
+	if err != nil {
+		return nil, err
+	}
+	pingPool, err := arrowflight.NewPool(afArgs, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &DremioRepository{args: args, pool: pool, pingPool: pingPool, journal: j, requestTable: rt, sampleTable: st, migrationTable: mt, children: children,
+		patientTable: pt, patientAliasTable: pat}, nil
 }
 
-func (r *DremioRepository) AddRequest(ctx context.Context, sr smile.Request) error {
-	af, err := arrowflight.NewArrowFlight(r.args.Host, r.args.Username, r.args.Password)
+func newAuthenticator(args DremioArgs) (arrowflight.Authenticator, error) {
+	switch args.AuthMode {
+	case "", AuthBasic:
+		if args.Username == "" {
+			return nil, errors.New("username must not be empty")
+		}
+		if args.Password == "" {
+			return nil, errors.New("password must not be empty")
+		}
+		return arrowflight.BasicAuth(args.Username, args.Password), nil
+	case AuthToken:
+		if args.Token == "" {
+			return nil, errors.New("token must not be empty")
+		}
+		return arrowflight.TokenAuth(args.Token), nil
+	case AuthTokenFile:
+		if args.TokenPath == "" {
+			return nil, errors.New("tokenpath must not be empty")
+		}
+		return arrowflight.TokenFileAuth(args.TokenPath), nil
+	default:
+		return nil, fmt.Errorf("unknown auth mode: %s", args.AuthMode)
+	}
+}
+
+// Close closes all arrow flight clients held by the repository
+func (r *DremioRepository) Close() error {
+	err := r.pool.Close()
+	if perr := r.pingPool.Close(); err == nil {
+		err = perr
+	}
+	return err
+}
+
+// withClient calls fn with a client from the pool, the client is discarded if fn fails in a way
+// that leaves it broken, see arrowflight.Pool.Release
+func (r *DremioRepository) withClient(ctx context.Context, fn func(*arrowflight.ArrowFlight) error) (err error) {
+	af, err := r.pool.Get(ctx)
 	if err != nil {
 		return err
 	}
-	defer af.FC.Close()
+	defer func() { r.pool.Release(af, err) }()
+	return fn(af)
+}
 
-	// lets check for existing request, if exists remove it and its samples
-	existingRequests, err := r.getRequests(af, sr)
+// Ping checks that dremio is reachable and accepts our credentials by running a trivial query.
+// it uses a client of its own, so it answers even while the workers hold every pooled client.
+func (r *DremioRepository) Ping(ctx context.Context) (err error) {
+	af, err := r.pingPool.Get(ctx)
 	if err != nil {
 		return err
 	}
-	if len(existingRequests) > 0 {
-		err = r.removeRequest(af, existingRequests[0])
+	defer func() { r.pingPool.Release(af, err) }()
+	return r.query(ctx, af, "ping", "select 1", func(rec array.Record) error { return nil })
+}
+
+// AddRequest replaces any stored version of sr and its samples with sr, as configured by
+// args.AddStrategy. errors for which retrying may help are marked transient, see IsTransient.
+func (r *DremioRepository) AddRequest(ctx context.Context, sr smile.Request) error {
+	e, err := r.journal.begin(sr)
+	if err != nil {
+		// a local disk problem, the message should be redelivered rather than dead lettered
+		return &TransientError{fmt.Errorf("cannot journal request: %w", err)}
+	}
+	err = r.add(ctx, sr)
+	r.settle(ctx, e, err)
+	return err
+}
+
+// Recover completes the adds interrupted by a crash using the journal, it should be called
+// before messages are consumed. adds failing permanently are logged and dropped, a transient
+// error stops recovery and leaves the remaining entries for the next start. entries that cannot
+// be read are logged and quarantined.
+func (r *DremioRepository) Recover(ctx context.Context) error {
+	pending, err := r.journal.pending()
+	if err != nil {
+		return err
+	}
+	for _, e := range pending {
+		sr, err := e.request()
+		if errors.Is(err, errCorruptEntry) {
+			logging.FromContext(ctx).Error("Could not read journal entry, quarantining it", "error", err)
+			if err := r.journal.quarantine(e); err != nil {
+				return fmt.Errorf("cannot quarantine journal entry: %w", err)
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		err = r.removeSamples(af, existingRequests[0])
+		logger := logging.FromContext(ctx).With(logging.IgoRequestID, sr.IgoRequestID)
+		logger.Warn("Recovering interrupted add request")
+		err = r.add(ctx, sr)
+		if IsTransient(err) {
+			return fmt.Errorf("cannot recover request %s: %w", sr.IgoRequestID, err)
+		}
+		if err != nil {
+			logger.Error("Could not recover request, dropping it from the journal", "error", err)
+		}
+		r.settle(ctx, e, err)
+	}
+	return nil
+}
+
+// add stores sr with the configured strategy, retrying transient errors. a failed attempt may
+// have written some of its rows, both strategies replace them rather than adding to them.
+func (r *DremioRepository) add(ctx context.Context, sr smile.Request) error {
+	return r.retry(ctx, func() error {
+		return r.withClient(ctx, func(af *arrowflight.ArrowFlight) error {
+			if r.args.AddStrategy == AddMerge {
+				return r.mergeRequest(ctx, af, sr)
+			}
+			return r.addRequest(ctx, af, sr)
+		})
+	})
+}
+
+// settle removes the journal entry of an add that is done. adds that failed with a transient
+// error are kept, they are redelivered or else completed by Recover.
+func (r *DremioRepository) settle(ctx context.Context, e journalEntry, err error) {
+	if IsTransient(err) {
+		return
+	}
+	if err := r.journal.commit(e); err != nil {
+		logging.FromContext(ctx).Warn("Could not remove journal entry", "error", err)
+	}
+}
+
+// addRequest deletes any stored version of sr and inserts it. the samples of sr are deleted even
+// when no request row exists, an earlier attempt may have stored them before failing, so the add
+// can be retried or replayed by Recover without duplicating rows.
+func (r *DremioRepository) addRequest(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	// lets check for existing request, if exists remove it
+	existingRequests, err := r.getRequests(ctx, af, sr)
+	if err != nil {
+		return err
+	}
+	if len(existingRequests) > 0 {
+		err = r.removeRequest(ctx, af, existingRequests[0])
 		if err != nil {
 			return err
 		}
 	}
+	err = r.removeSamples(ctx, af, sr)
+	if err != nil {
+		return err
+	}
 
 	// lets save samples first, because we want to remove them from request before saving request
 	// its also more likely that we will encounter an error here than when saving a request because
 	// 1 request -> 1 or more samples
-	err = r.insertSamples(af, sr)
+	err = r.insertSamples(ctx, af, sr)
+	if err == nil {
+		err = r.insertChildren(ctx, af, sr.IgoRequestID, sr.Samples...)
+	}
+	if err == nil {
+		err = r.upsertPatients(ctx, af, sr.Samples...)
+	}
 	if err != nil {
 		// remove any inserted samples before failure where IGO_REQUEST_ID == sr.IgoRequestID
-		r.removeSamples(af, sr)
+		r.removeSamples(ctx, af, sr)
 		return err
 	}
 
-	err = r.insertRequest(af, sr)
+	err = r.insertRequest(ctx, af, sr)
 	if err != nil {
 		// remove inserted samples where IGO_REQUEST_ID == sr.IgoRequestID
-		r.removeSamples(af, sr)
+		r.removeSamples(ctx, af, sr)
 		return err
 	}
 
 	return nil
 }
 
-func (r *DremioRepository) getRequests(af *arrowflight.ArrowFlight, sr smile.Request) ([]smile.Request, error) {
-	var requests []smile.Request
-	query := fmt.Sprintf("select * from %s.%s where IGO_REQUEST_ID = '%s'", r.args.ObjectStore, r.args.RequestTable, sr.IgoRequestID)
-	rdr, err := af.Query(query)
+// mergeRequest replaces the stored version of sr using statements that each change a single table
+// atomically: the samples are upserted, samples no longer part of sr are removed and the request
+// is upserted last. unlike addRequest, a failure part way never leaves a request without samples.
+func (r *DremioRepository) mergeRequest(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	rows, err := r.sampleRows(sr)
 	if err != nil {
-		return requests, err
+		return err
+	}
+	keep := make([]interface{}, len(sr.Samples))
+	for i, s := range sr.Samples {
+		keep[i] = s.SampleName
+	}
+	// each batch is atomic on its own, the journal covers failures between them
+	for _, c := range r.batches(rows) {
+		query := mergeStmt(r.sampleTable, r.sampleColumns(), []string{"IGO_REQUEST_ID", "IGO_SAMPLE_NAME"}, rows[c[0]:c[1]]...)
+		if _, err := r.exec(ctx, af, "merge_samples", arrowflight.OpInsert, query); err != nil {
+			return err
+		}
+	}
+	query := deleteNotInStmt(r.sampleTable, []column{{"IGO_REQUEST_ID", sr.IgoRequestID}}, "IGO_SAMPLE_NAME", keep)
+	if _, err := r.exec(ctx, af, "delete_stale_samples", arrowflight.OpDelete, query); err != nil {
+		return err
+	}
+	if err := r.replaceChildren(ctx, af, sr); err != nil {
+		return err
+	}
+	if err := r.upsertPatients(ctx, af, sr.Samples...); err != nil {
+		return err
+	}
+	rJson, err := requestJSON(sr)
+	if err != nil {
+		return err
+	}
+	query = mergeStmt(r.requestTable, requestColumns, []string{"IGO_REQUEST_ID"}, []interface{}{sr.IgoRequestID, rJson})
+	_, err = r.exec(ctx, af, "merge_request", arrowflight.OpInsert, query)
+	return err
+}
+
+// statementContext bounds a single statement by args.StatementTimeout, if set
+func (r *DremioRepository) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.args.StatementTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	defer rdr.Release()
-	for rdr.Next() {
-		rec := rdr.Record()
+	return context.WithTimeout(ctx, r.args.StatementTimeout)
+}
+
+// exec runs a dml statement bounded by the statement timeout, recording its latency and span under kind
+func (r *DremioRepository) exec(ctx context.Context, af *arrowflight.ArrowFlight, kind string, op arrowflight.Operation, stmt string) (int64, error) {
+	ctx, span := startStatementSpan(ctx, kind, op)
+	defer span.End()
+	ctx, cancel := r.statementContext(ctx)
+	defer cancel()
+	start := time.Now()
+	n, err := af.Exec(ctx, op, stmt)
+	observeStatement(kind, start, err)
+	endStatementSpan(span, n, err)
+	logging.FromContext(ctx).Debug("Executed statement", "statement", kind, "rows", n, "duration", time.Since(start), "error", err)
+	return n, statementError(err)
+}
+
+// query is the exec counterpart for statements returning rows, fn is called with every record
+func (r *DremioRepository) query(ctx context.Context, af *arrowflight.ArrowFlight, kind string, stmt string, fn arrowflight.RecordFunc) error {
+	ctx, span := startStatementSpan(ctx, kind, arrowflight.OpLookup)
+	defer span.End()
+	ctx, cancel := r.statementContext(ctx)
+	defer cancel()
+	start := time.Now()
+	err := af.Query(ctx, arrowflight.OpLookup, stmt, fn)
+	observeStatement(kind, start, err)
+	endStatementSpan(span, -1, err)
+	logging.FromContext(ctx).Debug("Executed query", "statement", kind, "duration", time.Since(start), "error", err)
+	return statementError(err)
+}
+
+// statementError maps grpc deadline and cancellation errors onto their context counterparts
+// so callers can tell timed out statements apart with errors.Is
+func statementError(err error) error {
+	switch status.Code(err) {
+	case codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %s", context.DeadlineExceeded, err)
+	case codes.Canceled:
+		return fmt.Errorf("%w: %s", context.Canceled, err)
+	}
+	return err
+}
+
+func (r *DremioRepository) getRequests(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) ([]smile.Request, error) {
+	var requests []smile.Request
+	query := selectStmt(r.requestTable, column{"IGO_REQUEST_ID", sr.IgoRequestID})
+	err := r.query(ctx, af, "select_request", query, func(rec array.Record) error {
 		for i := 0; i < int(rec.NumRows()); i++ {
 			var r smile.Request
 			for j := 0; j < int(rec.NumCols()); j++ {
@@ -106,156 +510,146 @@ func (r *DremioRepository) getRequests(af *arrowflight.ArrowFlight, sr smile.Req
 				case "IGO_REQUEST_ID":
 					continue
 				case "REQUEST_JSON":
-					err = json.Unmarshal([]byte(rec.Column(j).(*array.String).Value(i)), &r)
+					err := json.Unmarshal([]byte(rec.Column(j).(*array.String).Value(i)), &r)
 					if err != nil {
-						return nil, err
+						return err
 					} else {
 						requests = append(requests, r)
 					}
 				}
 			}
 		}
-		rec.Release()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return requests, nil
 }
 
-func (r *DremioRepository) removeRequest(af *arrowflight.ArrowFlight, sr smile.Request) error {
-	query := fmt.Sprintf("delete from %s.%s where IGO_REQUEST_ID = '%s'", r.args.ObjectStore, r.args.RequestTable, sr.IgoRequestID)
-	_, err := af.Query(query)
+func (r *DremioRepository) removeRequest(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	query := deleteStmt(r.requestTable, column{"IGO_REQUEST_ID", sr.IgoRequestID})
+	_, err := r.exec(ctx, af, "delete_request", arrowflight.OpDelete, query)
+	return err
+}
+
+// insertSamples inserts the samples of sr in batches. when dremio rejects a batch for a reason
+// other than a transient error, its samples are inserted one at a time to find the offending one.
+func (r *DremioRepository) insertSamples(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	rows, err := r.sampleRows(sr)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (r *DremioRepository) insertSamples(af *arrowflight.ArrowFlight, sr smile.Request) error {
-	for _, s := range sr.Samples {
-		sJson, err := json.Marshal(s)
-		if err != nil {
-			return err
+	for _, c := range r.batches(rows) {
+		batch := rows[c[0]:c[1]]
+		_, err := r.exec(ctx, af, "insert_samples", arrowflight.OpInsert, insertStmt(r.sampleTable, r.sampleColumns(), batch...))
+		if err == nil {
+			continue
 		}
-		query := fmt.Sprintf("insert into %s.%s values ('%s', '%s', '%s', '%s', '%s', '%s')", r.args.ObjectStore, r.args.SampleTable, sr.IgoRequestID, s.SampleName, s.CmoSampleName, s.CFDNA2DBarcode, s.CmoPatientID, string(sJson))
-		_, err = af.Query(query)
-		if err != nil {
+		if len(batch) == 1 {
+			return fmt.Errorf("inserting sample %s: %w", sr.Samples[c[0]].SampleName, err)
+		}
+		if IsTransient(classify(err)) {
 			return err
 		}
+		logging.FromContext(ctx).Warn("Batch insert failed, inserting its samples one at a time", "samples", len(batch), "error", err)
+		for i, row := range batch {
+			if err := r.insertRow(ctx, af, row); err != nil {
+				return fmt.Errorf("inserting sample %s: %w", sr.Samples[c[0]+i].SampleName, err)
+			}
+		}
 	}
 	return nil
 }
 
-func (r *DremioRepository) insertSamplesOptimized(af *arrowflight.ArrowFlight, sr smile.Request) error {
-
-	var b strings.Builder
-	fmt.Fprintf(&b, "insert into %s.%s values ", r.args.ObjectStore, r.args.SampleTable)
-	for _, s := range sr.Samples {
-		sJson, err := json.Marshal(s)
-		if err != nil {
-			return err
-		}
-		fmt.Fprintf(&b, "('%s', '%s', '%s', '%s', '%s', '%s'),", sr.IgoRequestID, s.SampleName, s.CmoSampleName, s.CFDNA2DBarcode, s.CmoPatientID, string(sJson))
+// batches splits rows into the ranges written by a single statement, see chunks
+func (r *DremioRepository) batches(rows [][]interface{}) [][2]int {
+	sizes := make([]int, len(rows))
+	for i, row := range rows {
+		sizes[i] = rowSize(row)
 	}
-	query := b.String()
-	query = strings.TrimRight(query, ",")
-	_, err := af.Query(query)
-	if err != nil {
-		return err
-	}
-	return nil
+	return chunks(sizes, r.args.InsertBatchRows, r.args.InsertBatchBytes)
 }
 
-func (r *DremioRepository) insertRequest(af *arrowflight.ArrowFlight, sr smile.Request) error {
-	// clobber samples in sr.Samples[] before saving because they just got stored in the samples table
-	sr.Samples = sr.Samples[:0]
-	rJson, err := json.Marshal(sr)
-	if err != nil {
-		return err
-	}
-	query := fmt.Sprintf("insert into %s.%s values ('%s', '%s')", r.args.ObjectStore, r.args.RequestTable, sr.IgoRequestID, string(rJson))
-	_, err = af.Query(query)
+func (r *DremioRepository) insertRow(ctx context.Context, af *arrowflight.ArrowFlight, row []interface{}) error {
+	_, err := r.exec(ctx, af, "insert_sample", arrowflight.OpInsert, insertStmt(r.sampleTable, r.sampleColumns(), row))
+	return err
+}
+
+func (r *DremioRepository) insertRequest(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	rJson, err := requestJSON(sr)
 	if err != nil {
 		return err
 	}
-	return nil
+	query := insertStmt(r.requestTable, requestColumns, []interface{}{sr.IgoRequestID, rJson})
+	_, err = r.exec(ctx, af, "insert_request", arrowflight.OpInsert, query)
+	return err
 }
 
-func (r *DremioRepository) removeSamples(af *arrowflight.ArrowFlight, sr smile.Request) error {
-	query := fmt.Sprintf("delete from %s.%s where IGO_REQUEST_ID = '%s'", r.args.ObjectStore, r.args.SampleTable, sr.IgoRequestID)
-	_, err := af.Query(query)
-	if err != nil {
+func (r *DremioRepository) removeSamples(ctx context.Context, af *arrowflight.ArrowFlight, sr smile.Request) error {
+	query := deleteStmt(r.sampleTable, column{"IGO_REQUEST_ID", sr.IgoRequestID})
+	if _, err := r.exec(ctx, af, "delete_samples", arrowflight.OpDelete, query); err != nil {
 		return err
 	}
-	return nil
+	return r.deleteChildren(ctx, af, column{"IGO_REQUEST_ID", sr.IgoRequestID})
 }
 
+// UpdateRequest replaces the stored request sr[1] with sr[0].
+// errors for which retrying may help are marked transient, see IsTransient.
 func (r *DremioRepository) UpdateRequest(ctx context.Context, sr []smile.Request) error {
 	if len(sr) < 2 {
 		return fmt.Errorf("request metadata array contains less than two entries: %d", len(sr))
 	}
-	af, err := arrowflight.NewArrowFlight(r.args.Host, r.args.Username, r.args.Password)
-	if err != nil {
-		return err
-	}
-	defer af.FC.Close()
-
-	err = r.updateRequest(af, sr)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return r.retry(ctx, func() error {
+		return r.withClient(ctx, func(af *arrowflight.ArrowFlight) error {
+			return r.updateRequest(ctx, af, sr)
+		})
+	})
 }
 
-func (r *DremioRepository) updateRequest(af *arrowflight.ArrowFlight, sr []smile.Request) error {
+func (r *DremioRepository) updateRequest(ctx context.Context, af *arrowflight.ArrowFlight, sr []smile.Request) error {
 	rJson, err := json.Marshal(sr[0])
 	if err != nil {
 		return err
 	}
-	query := fmt.Sprintf("update %s.%s set IGO_REQUEST_ID = '%s', REQUEST_JSON = '%s' where IGO_REQUEST_ID = '%s'", r.args.ObjectStore, r.args.RequestTable, sr[0].IgoRequestID, string(rJson), sr[1].IgoRequestID)
-	rdr, err := af.Query(query)
+	query := updateStmt(r.requestTable,
+		[]column{{"IGO_REQUEST_ID", sr[0].IgoRequestID}, {"REQUEST_JSON", rJson}},
+		[]column{{"IGO_REQUEST_ID", sr[1].IgoRequestID}})
+	n, err := r.exec(ctx, af, "update_request", arrowflight.OpUpdate, query)
 	if err != nil {
 		return err
 	}
-	defer rdr.Release()
-	for rdr.Next() {
-		rec := rdr.Record()
-		defer rec.Release()
-		for i := 0; i < int(rec.NumRows()); i++ {
-			for j := 0; j < int(rec.NumCols()); j++ {
-				switch rec.ColumnName(j) {
-				case "Records":
-					result := rec.Column(j).(*array.Int64).Value(i)
-					if result == 0 {
-						return fmt.Errorf("Update failed, most likely cause is IGO Request Id in where close cannot be found: %s", sr[1].IgoRequestID)
-					}
-				}
-			}
-		}
+	if n == 0 {
+		return fmt.Errorf("Update failed, most likely cause is IGO Request Id in where close cannot be found: %s", sr[1].IgoRequestID)
 	}
 
 	return nil
 }
 
+// UpdateSample replaces the stored sample s[1] with s[0], or inserts s[0] if it is the only version.
+// errors for which retrying may help are marked transient, see IsTransient.
 func (r *DremioRepository) UpdateSample(ctx context.Context, s []smile.Sample) error {
-	af, err := arrowflight.NewArrowFlight(r.args.Host, r.args.Username, r.args.Password)
-	if err != nil {
-		return err
-	}
-	defer af.FC.Close()
+	return r.retry(ctx, func() error {
+		return r.withClient(ctx, func(af *arrowflight.ArrowFlight) error {
+			return r.applySampleUpdate(ctx, af, s)
+		})
+	})
+}
 
+func (r *DremioRepository) applySampleUpdate(ctx context.Context, af *arrowflight.ArrowFlight, s []smile.Sample) error {
 	if len(s) < 2 {
 		// sample updates should have at least 2 versions of metadata
 		// it could be that this sample failed validation, was fixed, and is now being published as an update
 		// check if this samples request exists in request table, if so, insert sample directly
 		var sr smile.Request
 		sr.IgoRequestID = s[0].AdditionalProperties.IgoRequestID
-		existingRequest, err := r.getRequests(af, sr)
+		existingRequest, err := r.getRequests(ctx, af, sr)
 		if err != nil {
 			return err
 		}
 		if len(existingRequest) > 0 {
 			// request record exists, lets just insert the sample directly and call it a day
-			err := r.insertSample(af, s[0])
+			err := r.insertSample(ctx, af, s[0])
 			if err != nil {
 				return err
 			} else {
@@ -267,7 +661,7 @@ func (r *DremioRepository) UpdateSample(ctx context.Context, s []smile.Sample) e
 		}
 	}
 
-	err = r.updateSample(af, s)
+	err := r.updateSample(ctx, af, s)
 	if err != nil {
 		return err
 	}
@@ -276,47 +670,104 @@ func (r *DremioRepository) UpdateSample(ctx context.Context, s []smile.Sample) e
 }
 
 // used when we get an sample update message, but the sample does not already exist in the dremo sample table
-func (r *DremioRepository) insertSample(af *arrowflight.ArrowFlight, s smile.Sample) error {
-	sJson, err := json.Marshal(s)
+func (r *DremioRepository) insertSample(ctx context.Context, af *arrowflight.ArrowFlight, s smile.Sample) error {
+	row, err := r.sampleRow(s.AdditionalProperties.IgoRequestID, s)
 	if err != nil {
 		return err
 	}
-	query := fmt.Sprintf("insert into %s.%s values ('%s', '%s', '%s', '%s', '%s', '%s')", r.args.ObjectStore, r.args.SampleTable, s.AdditionalProperties.IgoRequestID, s.SampleName, s.CmoSampleName, s.CFDNA2DBarcode, s.CmoPatientID, string(sJson))
-	_, err = af.Query(query)
-	if err != nil {
+	// an earlier attempt may have inserted the sample before failing
+	if _, err := r.exec(ctx, af, "delete_sample", arrowflight.OpDelete, deleteStmt(r.sampleTable, sampleKey(s)...)); err != nil {
 		return err
 	}
-	return nil
+	if err := r.insertRow(ctx, af, row); err != nil {
+		return err
+	}
+	if err := r.replaceSampleChildren(ctx, af, s, s); err != nil {
+		return err
+	}
+	return r.upsertPatients(ctx, af, s)
 }
 
-func (r *DremioRepository) updateSample(af *arrowflight.ArrowFlight, s []smile.Sample) error {
+func (r *DremioRepository) updateSample(ctx context.Context, af *arrowflight.ArrowFlight, s []smile.Sample) error {
 	sJson, err := json.Marshal(s[0])
 	if err != nil {
 		return err
 	}
 	// []smile.Sample is an ordered list of metadata in descending order:
 	// s[0] is most recent, s[1] is what is currently in dremio table
-	query := fmt.Sprintf("update %s.%s set IGO_REQUEST_ID = '%s', IGO_SAMPLE_NAME = '%s', CMO_SAMPLE_NAME = '%s', CFDNA2DBARCODE = '%s', CMO_PATIENT_ID = '%s', SAMPLE_JSON = '%s' where IGO_REQUEST_ID = '%s' and IGO_SAMPLE_NAME = '%s' and CMO_SAMPLE_NAME = '%s' and CFDNA2DBARCODE = '%s' and CMO_PATIENT_ID = '%s'", r.args.ObjectStore, r.args.SampleTable, s[0].AdditionalProperties.IgoRequestID, s[0].SampleName, s[0].CmoSampleName, s[0].CFDNA2DBarcode, s[0].CmoPatientID, string(sJson), s[1].AdditionalProperties.IgoRequestID, s[1].SampleName, s[1].CmoSampleName, s[1].CFDNA2DBarcode, s[1].CmoPatientID)
-	rdr, err := af.Query(query)
+	set := append(sampleKey(s[0]), column{"SAMPLE_JSON", sJson})
+	set = append(set, r.mappedValues(s[0])...)
+	query := updateStmt(r.sampleTable, set, sampleKey(s[1]))
+	n, err := r.exec(ctx, af, "update_sample", arrowflight.OpUpdate, query)
 	if err != nil {
 		return err
 	}
-	defer rdr.Release()
-	for rdr.Next() {
-		rec := rdr.Record()
-		defer rec.Release()
-		for i := 0; i < int(rec.NumRows()); i++ {
-			for j := 0; j < int(rec.NumCols()); j++ {
-				switch rec.ColumnName(j) {
-				case "Records":
-					result := rec.Column(j).(*array.Int64).Value(i)
-					if result == 0 {
-						return fmt.Errorf("Update failed, most likely cause is IGO_REQUEST_ID or IGO_SAMPLE_NAME or CMO_SAMPLE_NAME or CFDNA2DBARCODE or CMO_PATIENT_ID in where close cannot be found: %s %s %s %s %s", s[1].AdditionalProperties.IgoRequestID, s[1].SampleName, s[1].CmoSampleName, s[1].CFDNA2DBarcode, s[1].CmoPatientID)
-					}
-				}
-			}
+	if retry := updateStmt(r.sampleTable, set, sampleKey(s[0])); n == 0 && retry != query {
+		// an earlier attempt may have updated the row before failing, it then has the key of s[0]
+		// and updating it again is harmless
+		if n, err = r.exec(ctx, af, "update_sample", arrowflight.OpUpdate, retry); err != nil {
+			return err
 		}
 	}
+	if n == 0 {
+		return fmt.Errorf("Update failed, most likely cause is IGO_REQUEST_ID or IGO_SAMPLE_NAME or CMO_SAMPLE_NAME or CFDNA2DBARCODE or CMO_PATIENT_ID in where close cannot be found: %s %s %s %s %s", s[1].AdditionalProperties.IgoRequestID, s[1].SampleName, s[1].CmoSampleName, s[1].CFDNA2DBarcode, s[1].CmoPatientID)
+	}
 
-	return nil
+	if err := r.replaceSampleChildren(ctx, af, s[1], s[0]); err != nil {
+		return err
+	}
+	return r.updatePatient(ctx, af, s[1], s[0])
+}
+
+// columns of the request and sample tables once all migrations are applied, see CheckSchema.
+// sample rows additionally hold the columns of args.SampleColumns.
+var (
+	requestSchema = varchars("IGO_REQUEST_ID", "REQUEST_JSON")
+	sampleSchema  = varchars("IGO_REQUEST_ID", "IGO_SAMPLE_NAME", "CMO_SAMPLE_NAME", "CFDNA2DBARCODE", "CMO_PATIENT_ID", "SAMPLE_JSON")
+)
+
+var requestColumns = columnNames(requestSchema)
+
+// requestJSON returns the REQUEST_JSON value of sr, its samples are left out since they are
+// stored in the sample table
+func requestJSON(sr smile.Request) ([]byte, error) {
+	sr.Samples = sr.Samples[:0]
+	return json.Marshal(sr)
+}
+
+// sampleRow returns the values of a sample table row in the order of r.sampleColumns
+func (r *DremioRepository) sampleRow(igoRequestID string, s smile.Sample) ([]interface{}, error) {
+	sJson, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	row := []interface{}{igoRequestID, s.SampleName, s.CmoSampleName, s.CFDNA2DBarcode, s.CmoPatientID, sJson}
+	for _, c := range r.mappedValues(s) {
+		row = append(row, c.value)
+	}
+	return row, nil
+}
+
+// sampleRows returns the sample table rows of the samples of sr
+func (r *DremioRepository) sampleRows(sr smile.Request) ([][]interface{}, error) {
+	rows := make([][]interface{}, 0, len(sr.Samples))
+	for _, s := range sr.Samples {
+		row, err := r.sampleRow(sr.IgoRequestID, s)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// sampleKey returns the identifying columns of a sample table row
+func sampleKey(s smile.Sample) []column {
+	return []column{
+		{"IGO_REQUEST_ID", s.AdditionalProperties.IgoRequestID},
+		{"IGO_SAMPLE_NAME", s.SampleName},
+		{"CMO_SAMPLE_NAME", s.CmoSampleName},
+		{"CFDNA2DBARCODE", s.CFDNA2DBarcode},
+		{"CMO_PATIENT_ID", s.CmoPatientID},
+	}
 }
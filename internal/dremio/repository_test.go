@@ -3,9 +3,18 @@ package dremio_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight/flighttest"
 	"github.com/mskcc/smile-dremio-gateway/internal/dremio"
 	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"google.golang.org/grpc/codes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var newRequest = `
@@ -2265,67 +2274,683 @@ var updatedSample = `
 ]
 `
 
+const (
+	requestTable = `"local-minio"."smile"."requests"`
+	sampleTable  = `"local-minio"."smile"."samples"`
+)
+
 var dArgs = dremio.DremioArgs{
-	Host:         "localhost",
-	Username:     "",
-	Password:     "",
 	ObjectStore:  "\"local-minio\".smile",
 	RequestTable: "requests",
 	SampleTable:  "samples",
+	RetryBackoff: time.Millisecond,
 }
 
-func TestNewRequest(t *testing.T) {
-
-	var r smile.Request
-	err := json.Unmarshal([]byte(newRequest), &r)
+// newTestRepos returns a repository configured by args talking to a fresh flighttest server
+func newTestRepos(t *testing.T, args dremio.DremioArgs) (*flighttest.Server, *dremio.DremioRepository) {
+	t.Helper()
+	fs, err := flighttest.NewServer()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	t.Cleanup(fs.Close)
+	args.Host, args.Port = fs.Host, fs.Port
+	args.Username, args.Password = flighttest.Username, flighttest.Password
+	dr, err := dremio.NewDremioRepos(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dr.Close() })
+	return fs, dr
+}
+
+func unmarshal(t *testing.T, s string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		t.Fatal(err)
+	}
+}
 
-	dr, err := dremio.NewDremioRepos(dArgs)
+func literal(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func marshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func jsonLiteral(t *testing.T, v interface{}) string {
+	t.Helper()
+	return literal(marshal(t, v))
+}
+
+// columns of the sample table written with the default sample columns
+var (
+	mappedColumns = []string{"SMILE_SAMPLE_ID", "SMILE_PATIENT_ID", "ONCOTREE_CODE", "SAMPLE_TYPE", "TUMOR_OR_NORMAL",
+		"SAMPLE_CLASS", "BAIT_SET", "GENE_PANEL", "SPECIES", "SEX", "IGO_COMPLETE"}
+	sampleColumns = append([]string{"IGO_REQUEST_ID", "IGO_SAMPLE_NAME", "CMO_SAMPLE_NAME", "CFDNA2DBARCODE", "CMO_PATIENT_ID", "SAMPLE_JSON"},
+		mappedColumns...)
+)
+
+// mappedValues returns the literals of the default sample columns of s, see mappedColumns
+func mappedValues(s smile.Sample) []string {
+	return []string{uuidLiteral(s.SmileSampleID), uuidLiteral(s.SmilePatientID), literal(s.OncotreeCode),
+		literal(s.SampleType), literal(s.TumorOrNormal), literal(s.SampleClass), literal(s.BaitSet), literal(s.GenePanel),
+		literal(s.Species), literal(s.Sex), strings.ToUpper(strconv.FormatBool(s.IgoComplete))}
+}
+
+// uuidLiteral returns id as sql, the nil uuid is stored as null
+func uuidLiteral(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return "NULL"
+	}
+	return literal(id.String())
+}
+
+// mappedSet returns the assignments of the default sample columns of s
+func mappedSet(s smile.Sample) string {
+	values := mappedValues(s)
+	set := make([]string, len(values))
+	for i, v := range values {
+		set[i] = mappedColumns[i] + " = " + v
+	}
+	return strings.Join(set, ", ")
+}
+
+func sampleValues(t *testing.T, igoRequestID string, s smile.Sample) string {
+	t.Helper()
+	return strings.Join(append([]string{literal(igoRequestID), literal(s.SampleName), literal(s.CmoSampleName),
+		literal(s.CFDNA2DBarcode), literal(s.CmoPatientID), jsonLiteral(t, s)}, mappedValues(s)...), ", ")
+}
+
+func sampleWhere(s smile.Sample) string {
+	return "IGO_REQUEST_ID = " + literal(s.AdditionalProperties.IgoRequestID) +
+		" and IGO_SAMPLE_NAME = " + literal(s.SampleName) +
+		" and CMO_SAMPLE_NAME = " + literal(s.CmoSampleName) +
+		" and CFDNA2DBARCODE = " + literal(s.CFDNA2DBarcode) +
+		" and CMO_PATIENT_ID = " + literal(s.CmoPatientID)
+}
+
+// sampleInsert returns the statement inserting samples in a single batch
+func sampleInsert(t *testing.T, igoRequestID string, samples ...smile.Sample) string {
+	t.Helper()
+	values := make([]string, len(samples))
+	for i, s := range samples {
+		values[i] = "(" + sampleValues(t, igoRequestID, s) + ")"
+	}
+	return "insert into " + sampleTable + " (" + strings.Join(sampleColumns, ", ") + ") values " + strings.Join(values, ", ")
+}
+
+// addRequestStatements returns the statements storing r once any previous version has been removed
+func addRequestStatements(t *testing.T, r smile.Request) []string {
+	t.Helper()
+	want := []string{sampleInsert(t, r.IgoRequestID, r.Samples...)}
+	r.Samples = r.Samples[:0]
+	return append(want, "insert into "+requestTable+" (IGO_REQUEST_ID, REQUEST_JSON) values ("+literal(r.IgoRequestID)+", "+jsonLiteral(t, r)+")")
+}
+
+// newRequestStatements returns the statements adding r when no version of it is stored: the
+// lookup of the request, the removal of samples left by an earlier attempt and the inserts
+func newRequestStatements(t *testing.T, r smile.Request) []string {
+	t.Helper()
+	want := []string{
+		"select * from " + requestTable + " where IGO_REQUEST_ID = " + literal(r.IgoRequestID),
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = " + literal(r.IgoRequestID),
+	}
+	return append(want, addRequestStatements(t, r)...)
+}
+
+func assertStatements(t *testing.T, fs *flighttest.Server, want []string) {
+	t.Helper()
+	got := fs.Statements()
+	if len(got) != len(want) {
+		t.Fatalf("got %d statements, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d:\ngot  %.300s\nwant %.300s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	fs, dr := newTestRepos(t, dArgs)
+	if err := dr.Ping(context.Background()); err != nil {
+		t.Fatal(err)
 	}
-	err = dr.AddRequest(context.Background(), r)
+	assertStatements(t, fs, []string{"select 1"})
+}
+
+func TestPingWithPoolInUse(t *testing.T) {
+	args := dArgs
+	args.PoolSize = 1
+	fs, dr := newTestRepos(t, args)
+	af, err := dr.Pool().Get(context.Background())
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	defer dr.Pool().Put(af)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dr.Ping(ctx); err != nil {
+		t.Fatalf("Ping returned %v while the pool was in use", err)
+	}
+	assertStatements(t, fs, []string{"select 1"})
+}
+
+func TestNewRequest(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	// no stored version of the request
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, newRequestStatements(t, r))
+}
+
+func TestNewRequestReplacesExisting(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	stored := r
+	stored.Samples = nil
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON", marshal(t, stored)))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"select * from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		"delete from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'",
+	}
+	assertStatements(t, fs, append(want, addRequestStatements(t, r)...))
+}
+
+func TestNewRequestRemovesSamplesOnFailure(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	tests := []struct {
+		name    string
+		prefix  string
+		results []flighttest.Result
+		// number of statements sent before cleaning up
+		sent int
+	}{
+		// the batch is rejected, then the second sample on its own
+		{"sample insert fails", "insert into " + sampleTable,
+			[]flighttest.Result{flighttest.Error(codes.InvalidArgument, "bad row"), flighttest.Records(1), flighttest.Error(codes.InvalidArgument, "bad row")}, 5},
+		{"request insert fails", "insert into " + requestTable,
+			[]flighttest.Result{flighttest.Error(codes.InvalidArgument, "bad row")}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, dr := newTestRepos(t, dArgs)
+			fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+			fs.Respond(tt.prefix, tt.results...)
+
+			err := dr.AddRequest(context.Background(), r)
+			if err == nil || dremio.IsTransient(err) {
+				t.Fatalf("AddRequest returned %v, want a permanent error", err)
+			}
+			got := fs.Statements()
+			if len(got) != tt.sent+1 {
+				t.Fatalf("got %d statements, want %d", len(got), tt.sent+1)
+			}
+			if want := "delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'"; got[len(got)-1] != want {
+				t.Errorf("last statement = %.300s, want %s", got[len(got)-1], want)
+			}
+		})
+	}
+}
+
+func TestNewRequestBatchesSamples(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	tests := []struct {
+		name string
+		args func(*dremio.DremioArgs)
+		// sizes of the expected batches
+		want []int
+	}{
+		{"default", func(*dremio.DremioArgs) {}, []int{22}},
+		{"by rows", func(a *dremio.DremioArgs) { a.InsertBatchRows = 8 }, []int{8, 8, 6}},
+		// every sample is larger than the limit
+		{"by bytes", func(a *dremio.DremioArgs) { a.InsertBatchBytes = 100 }, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := dArgs
+			tt.args(&args)
+			fs, dr := newTestRepos(t, args)
+			fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+			if err := dr.AddRequest(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+			want := newRequestStatements(t, r)[:2]
+			start := 0
+			for _, n := range tt.want {
+				want = append(want, sampleInsert(t, r.IgoRequestID, r.Samples[start:start+n]...))
+				start += n
+			}
+			all := addRequestStatements(t, r)
+			assertStatements(t, fs, append(want, all[len(all)-1]))
+		})
+	}
+}
+
+func TestNewRequestPinpointsRejectedSample(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	bad := r.Samples[2]
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	fs.Respond(sampleInsert(t, r.IgoRequestID, bad), flighttest.Error(codes.InvalidArgument, "value too long"))
+	fs.Respond(sampleInsert(t, r.IgoRequestID, r.Samples...), flighttest.Error(codes.InvalidArgument, "value too long"))
+
+	err := dr.AddRequest(context.Background(), r)
+	if err == nil || !strings.Contains(err.Error(), "inserting sample "+bad.SampleName) {
+		t.Fatalf("AddRequest returned %v, want an error naming sample %s", err, bad.SampleName)
+	}
+	want := []string{
+		"select * from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'",
+		sampleInsert(t, r.IgoRequestID, r.Samples...),
+		sampleInsert(t, r.IgoRequestID, r.Samples[0]),
+		sampleInsert(t, r.IgoRequestID, r.Samples[1]),
+		sampleInsert(t, r.IgoRequestID, bad),
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ'",
+	}
+	assertStatements(t, fs, want)
+}
+
+func TestNewRequestRetriesTransientErrors(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Error(codes.Unavailable, "dremio is restarting"), flighttest.Strings("REQUEST_JSON"))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	selectRequest := "select * from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'"
+	assertStatements(t, fs, append([]string{selectRequest}, newRequestStatements(t, r)...))
+}
+
+func TestNewRequestRetryRemovesCommittedSamples(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	// the samples are written but the answer is lost, and so is the cleanup
+	fs.Respond("insert into "+sampleTable, flighttest.Error(codes.Unavailable, "connection reset"), flighttest.Records(int64(len(r.Samples))))
+	fs.Respond("delete from "+sampleTable, flighttest.Records(0), flighttest.Error(codes.Unavailable, "connection reset"), flighttest.Records(int64(len(r.Samples))))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	// the retry deletes the samples of the first attempt before inserting them again
+	stmts := newRequestStatements(t, r)
+	want := append(stmts[:3:3], stmts[1])
+	assertStatements(t, fs, append(want, stmts...))
+}
+
+func TestNewRequestGivesUpOnTransientErrors(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Error(codes.Unavailable, "dremio is down"))
+
+	err := dr.AddRequest(context.Background(), r)
+	if !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	// the first attempt and the default number of retries
+	if got := len(fs.Statements()); got != 4 {
+		t.Errorf("got %d statements, want 4", got)
 	}
 }
 
 func TestUpdateRequest(t *testing.T) {
+	var r []smile.Request
+	unmarshal(t, updatedRequest, &r)
+	want := []string{"update " + requestTable + " set IGO_REQUEST_ID = '22022_BZ', REQUEST_JSON = " + jsonLiteral(t, r[0]) +
+		" where IGO_REQUEST_ID = '22022_BZ'"}
+
+	tests := []struct {
+		name    string
+		result  flighttest.Result
+		wantErr string
+	}{
+		{"updated", flighttest.Records(1), ""},
+		{"request not found", flighttest.Records(0), "Update failed"},
+		{"rejected", flighttest.Error(codes.InvalidArgument, "syntax error"), "syntax error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, dr := newTestRepos(t, dArgs)
+			fs.Respond("update", tt.result)
+			err := dr.UpdateRequest(context.Background(), r)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("UpdateRequest returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			assertStatements(t, fs, want)
+		})
+	}
+}
 
+func TestUpdateRequestSingleVersion(t *testing.T) {
 	var r []smile.Request
-	err := json.Unmarshal([]byte(updatedRequest), &r)
-	if err != nil {
-		t.Error(err)
+	unmarshal(t, updatedRequest, &r)
+	fs, dr := newTestRepos(t, dArgs)
+	if err := dr.UpdateRequest(context.Background(), r[:1]); err == nil {
+		t.Fatal("expected error")
 	}
+	assertStatements(t, fs, nil)
+}
 
-	dr, err := dremio.NewDremioRepos(dArgs)
-	if err != nil {
-		t.Error(err)
+func TestUpdateSample(t *testing.T) {
+	var s []smile.Sample
+	unmarshal(t, updatedSample, &s)
+	update := "update " + sampleTable + " set " + strings.ReplaceAll(sampleWhere(s[0]), " and ", ", ") +
+		", SAMPLE_JSON = " + jsonLiteral(t, s[0]) + ", " + mappedSet(s[0]) + " where "
+
+	tests := []struct {
+		name    string
+		result  flighttest.Result
+		wantErr string
+		want    []string
+	}{
+		{"updated", flighttest.Records(1), "", []string{update + sampleWhere(s[1])}},
+		// the row may hold s[0] already, so that is tried before giving up
+		{"sample not found", flighttest.Records(0), "Update failed", []string{update + sampleWhere(s[1]), update + sampleWhere(s[0])}},
+		{"rejected", flighttest.Error(codes.InvalidArgument, "syntax error"), "syntax error", []string{update + sampleWhere(s[1])}},
 	}
-	// tbd: query before and after
-	err = dr.UpdateRequest(context.Background(), r)
-	if err != nil {
-		t.Error(err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, dr := newTestRepos(t, dArgs)
+			fs.Respond("update", tt.result)
+			err := dr.UpdateSample(context.Background(), s)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("UpdateSample returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			assertStatements(t, fs, tt.want)
+		})
 	}
 }
 
-func TestUpdateSample(t *testing.T) {
+func TestNilIDsAreStoredAsNull(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	r.Samples = r.Samples[:1]
+	r.Samples[0].SmileSampleID, r.Samples[0].SmilePatientID = uuid.Nil, uuid.Nil
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	insert := fs.Statements()[2]
+	// SAMPLE_JSON keeps the nil uuids, the columns do not
+	values := insert[strings.LastIndex(insert, "}',")+len("}',"):]
+	if !strings.HasPrefix(values, " NULL, NULL, ") || strings.Contains(values, uuid.Nil.String()) {
+		t.Errorf("got columns %s, want the smile sample and patient ids to be NULL", values)
+	}
+}
 
+func TestUpdateSampleSingleVersion(t *testing.T) {
 	var s []smile.Sample
-	err := json.Unmarshal([]byte(updatedSample), &s)
+	unmarshal(t, updatedSample, &s)
+	selectRequest := "select * from " + requestTable + " where IGO_REQUEST_ID = '22022_BZ'"
+
+	// the request is stored, so the sample is inserted
+	fs, dr := newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON", `{"igoRequestId":"22022_BZ"}`))
+	if err := dr.UpdateSample(context.Background(), s[:1]); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, []string{selectRequest, "delete from " + sampleTable + " where " + sampleWhere(s[0]), sampleInsert(t, "22022_BZ", s[0])})
+
+	// without a stored request there is nothing to attach the sample to
+	fs, dr = newTestRepos(t, dArgs)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	if err := dr.UpdateSample(context.Background(), s[:1]); err == nil {
+		t.Fatal("expected error")
+	}
+	assertStatements(t, fs, []string{selectRequest})
+}
+
+func TestStatementTimeout(t *testing.T) {
+	args := dArgs
+	args.StatementTimeout = time.Nanosecond
+	args.MaxRetries = -1
+	_, dr := newTestRepos(t, args)
+	if err := dr.Ping(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Ping returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewRequestMerge(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.AddStrategy = dremio.AddMerge
+	fs, dr := newTestRepos(t, args)
+
+	if err := dr.AddRequest(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	var values, names []string
+	for _, s := range r.Samples {
+		values = append(values, "("+sampleValues(t, r.IgoRequestID, s)+")")
+		names = append(names, literal(s.SampleName))
+	}
+	var set, source []string
+	for _, c := range sampleColumns {
+		if c != "IGO_REQUEST_ID" && c != "IGO_SAMPLE_NAME" {
+			set = append(set, c+" = s."+c)
+		}
+		source = append(source, "s."+c)
+	}
+	stored := r
+	stored.Samples = stored.Samples[:0]
+	assertStatements(t, fs, []string{
+		"merge into " + sampleTable + " as t using (values " + strings.Join(values, ", ") + ")" +
+			" as s(" + strings.Join(sampleColumns, ", ") + ")" +
+			" on t.IGO_REQUEST_ID = s.IGO_REQUEST_ID and t.IGO_SAMPLE_NAME = s.IGO_SAMPLE_NAME" +
+			" when matched then update set " + strings.Join(set, ", ") +
+			" when not matched then insert (" + strings.Join(sampleColumns, ", ") + ") values (" + strings.Join(source, ", ") + ")",
+		"delete from " + sampleTable + " where IGO_REQUEST_ID = '22022_BZ' and IGO_SAMPLE_NAME not in (" + strings.Join(names, ", ") + ")",
+		"merge into " + requestTable + " as t using (values ('22022_BZ', " + jsonLiteral(t, stored) + ")) as s(IGO_REQUEST_ID, REQUEST_JSON)" +
+			" on t.IGO_REQUEST_ID = s.IGO_REQUEST_ID when matched then update set REQUEST_JSON = s.REQUEST_JSON" +
+			" when not matched then insert (IGO_REQUEST_ID, REQUEST_JSON) values (s.IGO_REQUEST_ID, s.REQUEST_JSON)",
+	})
+}
+
+func TestNewRequestMergeStopsOnFailure(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.AddStrategy = dremio.AddMerge
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("merge into "+sampleTable, flighttest.Error(codes.InvalidArgument, "not an iceberg table"))
+
+	if err := dr.AddRequest(context.Background(), r); err == nil || dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a permanent error", err)
+	}
+	// nothing else is touched, the stored request and its samples are left as they were
+	if got := fs.Statements(); len(got) != 1 {
+		t.Fatalf("got %d statements, want only the failed merge", len(got))
+	}
+}
+
+func journalFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestRecover(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.JournalDir = t.TempDir()
+	args.MaxRetries = -1
+
+	// the add is interrupted after the samples were stored
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	fs.Respond("insert into "+requestTable, flighttest.Error(codes.Unavailable, "dremio is restarting"))
+	if err := dr.AddRequest(context.Background(), r); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	if n := journalFiles(t, args.JournalDir); n != 1 {
+		t.Fatalf("journal holds %d entries, want 1", n)
+	}
+
+	// the next start completes it
+	fs, dr = newTestRepos(t, args)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	if err := dr.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, newRequestStatements(t, r))
+	if n := journalFiles(t, args.JournalDir); n != 0 {
+		t.Errorf("journal holds %d entries after recovery, want 0", n)
 	}
+}
+
+func TestRecoverRemovesSamplesLeftInPlace(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.JournalDir = t.TempDir()
+	args.MaxRetries = -1
 
-	dr, err := dremio.NewDremioRepos(dArgs)
+	// the add is interrupted after the samples were stored and they cannot be cleaned up,
+	// leaving sample rows without a request row
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	fs.Respond("insert into "+requestTable, flighttest.Error(codes.Unavailable, "dremio is restarting"))
+	fs.Respond("delete from "+sampleTable, flighttest.Records(0), flighttest.Error(codes.Unavailable, "dremio is restarting"))
+	if err := dr.AddRequest(context.Background(), r); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+
+	// recovery finds no request row, it still removes the stored samples before inserting them again
+	fs, dr = newTestRepos(t, args)
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	fs.Respond("delete from "+sampleTable, flighttest.Records(int64(len(r.Samples))))
+	if err := dr.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertStatements(t, fs, newRequestStatements(t, r))
+}
+
+func TestRecoverQuarantinesCorruptEntries(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.JournalDir = t.TempDir()
+	args.MaxRetries = -1
+
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select", flighttest.Error(codes.Unavailable, "dremio is down"))
+	if err := dr.AddRequest(context.Background(), r); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	// a second add interrupted the same way, whose entry is then truncated
+	other := r
+	other.IgoRequestID = "22022_CC"
+	if err := dr.AddRequest(context.Background(), other); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	files, err := os.ReadDir(args.JournalDir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(args.JournalDir, files[1].Name()), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Reset()
+	fs.Respond("select", flighttest.Strings("REQUEST_JSON"))
+	if err := dr.Recover(context.Background()); err != nil {
+		t.Fatal(err)
 	}
-	// tbd: query before and after
-	err = dr.UpdateSample(context.Background(), s)
+	// the readable entry is still recovered
+	assertStatements(t, fs, newRequestStatements(t, r))
+	files, err = os.ReadDir(args.JournalDir)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".corrupt") {
+		t.Errorf("journal holds %v, want only the quarantined entry", files)
+	}
+}
+
+func TestAddRequestJournalFailureIsTransient(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.JournalDir = filepath.Join(t.TempDir(), "journal")
+	fs, dr := newTestRepos(t, args)
+	// the journal directory is gone, as with a volume that was unmounted
+	if err := os.RemoveAll(args.JournalDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := dr.AddRequest(context.Background(), r); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	if got := fs.Statements(); len(got) != 0 {
+		t.Errorf("got statements %v, want none without a journal entry", got)
+	}
+}
+
+func TestRecoverKeepsEntriesOnTransientErrors(t *testing.T) {
+	var r smile.Request
+	unmarshal(t, newRequest, &r)
+	args := dArgs
+	args.JournalDir = t.TempDir()
+	args.MaxRetries = -1
+
+	fs, dr := newTestRepos(t, args)
+	fs.Respond("select", flighttest.Error(codes.Unavailable, "dremio is down"))
+	if err := dr.AddRequest(context.Background(), r); !dremio.IsTransient(err) {
+		t.Fatalf("AddRequest returned %v, want a transient error", err)
+	}
+	if err := dr.Recover(context.Background()); !dremio.IsTransient(err) {
+		t.Fatalf("Recover returned %v, want a transient error", err)
+	}
+	if n := journalFiles(t, args.JournalDir); n != 1 {
+		t.Errorf("journal holds %d entries, want 1", n)
+	}
+
+	// permanent failures are dropped
+	fs.Reset()
+	fs.Respond("select", flighttest.Error(codes.InvalidArgument, "table not found"))
+	if err := dr.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := journalFiles(t, args.JournalDir); n != 0 {
+		t.Errorf("journal holds %d entries, want 0", n)
 	}
 }
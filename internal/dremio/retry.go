@@ -0,0 +1,37 @@
+package dremio
+
+import (
+	"context"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"time"
+)
+
+const (
+	defaultMaxRetries      = 3
+	defaultRetryBackoff    = 500 * time.Millisecond
+	defaultMaxRetryBackoff = 10 * time.Second
+)
+
+// retry calls fn until it succeeds, fails permanently, ctx is done or args.MaxRetries retries
+// have been made, doubling the wait between attempts up to args.MaxRetryBackoff.
+// the returned error has been classified, see IsTransient.
+func (r *DremioRepository) retry(ctx context.Context, fn func() error) error {
+	backoff := r.args.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := classify(fn())
+		if err == nil || !IsTransient(err) || attempt >= r.args.MaxRetries {
+			return err
+		}
+		logging.FromContext(ctx).Warn("Transient error, retrying", "attempt", attempt+1, "backoff", backoff, "error", err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > r.args.MaxRetryBackoff {
+			backoff = r.args.MaxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package dremio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{status.Error(codes.ResourceExhausted, "queue full"), true},
+		{status.Error(codes.Aborted, "aborted"), true},
+		{statementError(status.Error(codes.DeadlineExceeded, "deadline")), true},
+		{fmt.Errorf("wrapped: %w", status.Error(codes.Unavailable, "down")), true},
+		{context.Canceled, true},
+		{arrowflight.ErrPoolClosed, true},
+		{status.Error(codes.InvalidArgument, "syntax error"), false},
+		{status.Error(codes.Unauthenticated, "bad credentials"), false},
+		{errors.New("request does not exist"), false},
+	}
+	for _, tt := range tests {
+		err := classify(tt.err)
+		if got := IsTransient(err); got != tt.transient {
+			t.Errorf("IsTransient(classify(%v)) = %t, want %t", tt.err, got, tt.transient)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("classify(%v) does not wrap the original error", tt.err)
+		}
+	}
+	if classify(nil) != nil {
+		t.Error("classify(nil) != nil")
+	}
+}
+
+func testRetryRepo(maxRetries int) *DremioRepository {
+	return &DremioRepository{args: DremioArgs{
+		MaxRetries:      maxRetries,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: 2 * time.Millisecond,
+	}}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	badJSON := errors.New("bad json")
+	tests := []struct {
+		name          string
+		maxRetries    int
+		errs          []error
+		wantCalls     int
+		wantErr       error
+		wantTransient bool
+	}{
+		{"success", 3, []error{nil}, 1, nil, false},
+		{"recovers", 3, []error{unavailable, unavailable, nil}, 3, nil, false},
+		{"exhausted", 2, []error{unavailable, unavailable, unavailable, nil}, 3, unavailable, true},
+		{"permanent", 3, []error{badJSON, nil}, 1, badJSON, false},
+		{"disabled", -1, []error{unavailable, nil}, 1, unavailable, true},
+	}
+	for _, tt := range tests {
+		calls := 0
+		err := testRetryRepo(tt.maxRetries).retry(context.Background(), func() error {
+			err := tt.errs[calls]
+			calls++
+			return err
+		})
+		if calls != tt.wantCalls {
+			t.Errorf("%s: %d calls, want %d", tt.name, calls, tt.wantCalls)
+		}
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if got := IsTransient(err); got != tt.wantTransient {
+			t.Errorf("%s: IsTransient = %t, want %t", tt.name, got, tt.wantTransient)
+		}
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	r := testRetryRepo(100)
+	r.args.RetryBackoff = time.Hour
+	r.args.MaxRetryBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := r.retry(ctx, func() error {
+		calls++
+		return status.Error(codes.Unavailable, "down")
+	})
+	if calls != 1 {
+		t.Errorf("%d calls, want 1", calls)
+	}
+	if !IsTransient(err) {
+		t.Errorf("got %v, want transient error", err)
+	}
+}
@@ -0,0 +1,389 @@
+package dremio
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// column pairs a column name with the value to be written to (or matched against) it.
+// values are rendered as sql literals by sqlLiteral, they are never interpolated directly.
+type column struct {
+	name  string
+	value interface{}
+}
+
+// columnDef is a column of a table definition, typ is the sql type used in ddl such as VARCHAR
+type columnDef struct {
+	name string
+	typ  string
+}
+
+// quoteIdent returns s as a double quoted sql identifier, embedded double quotes are doubled
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// quoteLiteral returns s as a single quoted sql string literal, embedded single quotes are doubled.
+// dremio does not treat backslash as an escape character so it is passed through untouched.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlLiteral renders a go value as a sql literal
+func sqlLiteral(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return quoteLiteral(t)
+	case []byte:
+		return quoteLiteral(string(t))
+	case bool:
+		if t {
+			return "TRUE"
+		}
+		return "FALSE"
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case uuid.UUID:
+		return quoteLiteral(t.String())
+	case time.Time:
+		return "TIMESTAMP " + quoteLiteral(t.UTC().Format("2006-01-02 15:04:05.000"))
+	default:
+		return quoteLiteral(fmt.Sprint(t))
+	}
+}
+
+// splitPath splits a dotted dremio path such as "local-minio".smile into its components.
+// components may be double quoted, in which case dots are allowed and "" is an escaped quote.
+func splitPath(p string) ([]string, error) {
+	var parts []string
+	var b strings.Builder
+	inQuotes, quoted := false, false
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case inQuotes && c == '"':
+			if i+1 < len(p) && p[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+			} else {
+				inQuotes = false
+			}
+		case inQuotes:
+			b.WriteByte(c)
+		case c == '"':
+			if b.Len() > 0 || quoted {
+				return nil, fmt.Errorf("unexpected quote in path: %s", p)
+			}
+			inQuotes, quoted = true, true
+		case c == '.':
+			if b.Len() == 0 && !quoted {
+				return nil, fmt.Errorf("empty component in path: %s", p)
+			}
+			parts = append(parts, b.String())
+			b.Reset()
+			quoted = false
+		default:
+			if quoted {
+				return nil, fmt.Errorf("unexpected character after quote in path: %s", p)
+			}
+			b.WriteByte(c)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in path: %s", p)
+	}
+	if b.Len() == 0 && !quoted {
+		return nil, fmt.Errorf("empty component in path: %s", p)
+	}
+	return append(parts, b.String()), nil
+}
+
+// tablePath returns the fully qualified, quoted name of table under objectStore
+func tablePath(objectStore, table string) (string, error) {
+	if objectStore == "" || table == "" {
+		return "", errors.New("objectstore and table must not be empty")
+	}
+	parts, err := splitPath(objectStore)
+	if err != nil {
+		return "", err
+	}
+	tparts, err := splitPath(table)
+	if err != nil {
+		return "", err
+	}
+	return quotePath(append(parts, tparts...)), nil
+}
+
+// folderPath returns the quoted name of the objectStore folder
+func folderPath(objectStore string) (string, error) {
+	parts, err := splitPath(objectStore)
+	if err != nil {
+		return "", err
+	}
+	return quotePath(parts), nil
+}
+
+// viewPath returns the quoted name of view, a dotted path from the root of the catalog since
+// views live in spaces rather than under the objectStore source
+func viewPath(view string) (string, error) {
+	parts, err := splitPath(view)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) < 2 {
+		return "", fmt.Errorf("view must be qualified by its space: %s", view)
+	}
+	return quotePath(parts), nil
+}
+
+func quotePath(parts []string) string {
+	quoted := make([]string, len(parts))
+	for i, p := range parts {
+		quoted[i] = quoteIdent(p)
+	}
+	return strings.Join(quoted, ".")
+}
+
+// infoSchemaName returns the TABLE_SCHEMA and TABLE_NAME that INFORMATION_SCHEMA lists table
+// under objectStore with, the schema is the dotted path of the folder without quotes
+func infoSchemaName(objectStore, table string) (string, string, error) {
+	parts, err := splitPath(objectStore)
+	if err != nil {
+		return "", "", err
+	}
+	tparts, err := splitPath(table)
+	if err != nil {
+		return "", "", err
+	}
+	parts = append(parts, tparts...)
+	return strings.Join(parts[:len(parts)-1], "."), parts[len(parts)-1], nil
+}
+
+func writeWhere(b *strings.Builder, where []column) {
+	for i, c := range where {
+		if i == 0 {
+			b.WriteString(" where ")
+		} else {
+			b.WriteString(" and ")
+		}
+		fmt.Fprintf(b, "%s = %s", c.name, sqlLiteral(c.value))
+	}
+}
+
+// selectStmt builds: select * from tbl where c1 = v1 and ...
+func selectStmt(tbl string, where ...column) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "select * from %s", tbl)
+	writeWhere(&b, where)
+	return b.String()
+}
+
+// deleteStmt builds: delete from tbl where c1 = v1 and ...
+func deleteStmt(tbl string, where ...column) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "delete from %s", tbl)
+	writeWhere(&b, where)
+	return b.String()
+}
+
+// insertStmt builds: insert into tbl (c1, ...) values (...), (...)
+// naming the columns keeps inserts correct whatever order the table's columns are in
+func insertStmt(tbl string, cols []string, rows ...[]interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "insert into %s (%s) values ", tbl, strings.Join(cols, ", "))
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		writeRow(&b, row)
+	}
+	return b.String()
+}
+
+func writeRow(b *strings.Builder, row []interface{}) {
+	b.WriteByte('(')
+	for j, v := range row {
+		if j > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(sqlLiteral(v))
+	}
+	b.WriteByte(')')
+}
+
+// updateStmt builds: update tbl set c1 = v1, ... where c2 = v2 and ...
+func updateStmt(tbl string, set []column, where []column) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "update %s set ", tbl)
+	for i, c := range set {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = %s", c.name, sqlLiteral(c.value))
+	}
+	writeWhere(&b, where)
+	return b.String()
+}
+
+// deleteNotInStmt builds: delete from tbl where c1 = v1 and ... and col not in (x1, x2, ...)
+// with no values to keep it is a plain deleteStmt
+func deleteNotInStmt(tbl string, where []column, col string, keep []interface{}) string {
+	if len(keep) == 0 {
+		return deleteStmt(tbl, where...)
+	}
+	var b strings.Builder
+	b.WriteString(deleteStmt(tbl, where...))
+	if len(where) == 0 {
+		b.WriteString(" where ")
+	} else {
+		b.WriteString(" and ")
+	}
+	fmt.Fprintf(&b, "%s not in ", col)
+	writeRow(&b, keep)
+	return b.String()
+}
+
+// deleteInStmt builds: delete from tbl where col in (x1, x2, ...)
+func deleteInStmt(tbl string, col string, values []interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "delete from %s where %s in ", tbl, col)
+	writeRow(&b, values)
+	return b.String()
+}
+
+// countStmt builds: select count(*) from tbl where c1 = v1 and ...
+func countStmt(tbl string, where ...column) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "select count(*) from %s", tbl)
+	writeWhere(&b, where)
+	return b.String()
+}
+
+// mergeStmt builds an upsert of positional rows into tbl, matching rows on the key columns:
+// merge into tbl as t using (values (...), ...) as s(c1, ...) on t.k1 = s.k1 and ...
+// when matched then update set c2 = s.c2, ... when not matched then insert (c1, ...) values (s.c1, ...)
+func mergeStmt(tbl string, cols []string, key []string, rows ...[]interface{}) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "merge into %s as t using (values ", tbl)
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		writeRow(&b, row)
+	}
+	fmt.Fprintf(&b, ") as s(%s) on ", strings.Join(cols, ", "))
+	isKey := make(map[string]bool, len(key))
+	for i, k := range key {
+		if i > 0 {
+			b.WriteString(" and ")
+		}
+		fmt.Fprintf(&b, "t.%s = s.%[1]s", k)
+		isKey[k] = true
+	}
+	b.WriteString(" when matched then update set ")
+	first := true
+	for _, c := range cols {
+		if isKey[c] {
+			continue
+		}
+		if !first {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s = s.%[1]s", c)
+		first = false
+	}
+	fmt.Fprintf(&b, " when not matched then insert (%s) values (", strings.Join(cols, ", "))
+	for i, c := range cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("s." + c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// rowSize returns the length of row rendered by writeRow
+func rowSize(row []interface{}) int {
+	var b strings.Builder
+	writeRow(&b, row)
+	return b.Len()
+}
+
+// chunks splits rows of the given sizes into consecutive ranges [start, end) of at most maxRows
+// rows taking at most maxBytes bytes together, a row larger than maxBytes is a range of its own.
+// a limit of zero or less is no limit.
+func chunks(sizes []int, maxRows, maxBytes int) [][2]int {
+	var ranges [][2]int
+	start, bytes := 0, 0
+	for i, size := range sizes {
+		full := maxRows > 0 && i-start >= maxRows
+		tooBig := maxBytes > 0 && bytes+size > maxBytes
+		if i > start && (full || tooBig) {
+			ranges = append(ranges, [2]int{start, i})
+			start, bytes = i, 0
+		}
+		bytes += size
+	}
+	if start < len(sizes) {
+		ranges = append(ranges, [2]int{start, len(sizes)})
+	}
+	return ranges
+}
+
+// createTableStmt builds: create table if not exists tbl (c1 t1, ...)
+func createTableStmt(tbl string, cols []columnDef) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "create table if not exists %s (", tbl)
+	writeColumnDefs(&b, cols)
+	b.WriteString(")")
+	return b.String()
+}
+
+// addColumnsStmt builds: alter table tbl add columns (c1 t1, ...)
+func addColumnsStmt(tbl string, cols []columnDef) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "alter table %s add columns (", tbl)
+	writeColumnDefs(&b, cols)
+	b.WriteString(")")
+	return b.String()
+}
+
+func writeColumnDefs(b *strings.Builder, cols []columnDef) {
+	for i, c := range cols {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(b, "%s %s", c.name, c.typ)
+	}
+}
+
+// createFolderStmt builds: create folder if not exists folder
+func createFolderStmt(folder string) string {
+	return "create folder if not exists " + folder
+}
+
+// createViewStmt builds: create or replace view view as query
+func createViewStmt(view, query string) string {
+	return "create or replace view " + view + " as " + query
+}
+
+// columnsStmt builds the INFORMATION_SCHEMA query listing the name and type of the columns of a
+// table in order, see infoSchemaName
+func columnsStmt(schema, table string) string {
+	var b strings.Builder
+	b.WriteString(`select COLUMN_NAME, DATA_TYPE from INFORMATION_SCHEMA."COLUMNS"`)
+	writeWhere(&b, []column{{"TABLE_SCHEMA", schema}, {"TABLE_NAME", table}})
+	b.WriteString(" order by ORDINAL_POSITION")
+	return b.String()
+}
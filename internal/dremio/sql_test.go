@@ -0,0 +1,252 @@
+package dremio
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"22022_BZ", "'22022_BZ'"},
+		{"O'Brien", "'O''Brien'"},
+		{"''", "''''''"},
+		{"'; delete from samples; --", "'''; delete from samples; --'"},
+		{`C:\fastq\R1.fastq.gz`, `'C:\fastq\R1.fastq.gz'`},
+		{`trailing\`, `'trailing\'`},
+		{`\'`, `'\'''`},
+		{"Müller ☃ 日本語", "'Müller ☃ 日本語'"},
+		{"line1\nline2", "'line1\nline2'"},
+	}
+	for _, tt := range tests {
+		if got := quoteLiteral(tt.in); got != tt.want {
+			t.Errorf("quoteLiteral(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteLiteralLongPayload(t *testing.T) {
+	payload := strings.Repeat(`{"comments":"it's fine \\ ok"}`, 50000)
+	got := quoteLiteral(payload)
+	want := "'" + strings.Repeat(`{"comments":"it''s fine \\ ok"}`, 50000) + "'"
+	if got != want {
+		t.Fatalf("quoteLiteral of %d byte payload not escaped correctly", len(payload))
+	}
+	if unquoteLiteral(got) != payload {
+		t.Fatal("quoteLiteral of long payload does not round trip")
+	}
+}
+
+// unquoteLiteral reverses quoteLiteral, used to check round trips
+func unquoteLiteral(s string) string {
+	return strings.ReplaceAll(s[1:len(s)-1], "''", "'")
+}
+
+func TestSqlLiteral(t *testing.T) {
+	id := uuid.MustParse("afe74fba-8756-11eb-9b45-acde48001122")
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, "NULL"},
+		{"a'b", "'a''b'"},
+		{[]byte(`{"name":"O'Brien"}`), `'{"name":"O''Brien"}'`},
+		{true, "TRUE"},
+		{false, "FALSE"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{34.2, "34.2"},
+		{id, "'afe74fba-8756-11eb-9b45-acde48001122'"},
+		{time.Date(2023, 3, 1, 9, 30, 0, 5e6, time.FixedZone("EST", -5*3600)), "TIMESTAMP '2023-03-01 14:30:00.005'"},
+	}
+	for _, tt := range tests {
+		if got := sqlLiteral(tt.in); got != tt.want {
+			t.Errorf("sqlLiteral(%#v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"samples", `"samples"`},
+		{"local-minio", `"local-minio"`},
+		{`we"ird`, `"we""ird"`},
+		{"échantillons", `"échantillons"`},
+	}
+	for _, tt := range tests {
+		if got := quoteIdent(tt.in); got != tt.want {
+			t.Errorf("quoteIdent(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTablePath(t *testing.T) {
+	tests := []struct {
+		store, table, want string
+	}{
+		{`"local-minio".smile`, "samples", `"local-minio"."smile"."samples"`},
+		{"s3.smile", "requests", `"s3"."smile"."requests"`},
+		{`"my.bucket"."we""ird"`, "t", `"my.bucket"."we""ird"."t"`},
+		{"space", `"odd table"`, `"space"."odd table"`},
+	}
+	for _, tt := range tests {
+		got, err := tablePath(tt.store, tt.table)
+		if err != nil {
+			t.Errorf("tablePath(%q, %q) returned error: %s", tt.store, tt.table, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("tablePath(%q, %q) = %q, want %q", tt.store, tt.table, got, tt.want)
+		}
+	}
+
+	bad := []string{"", `"unterminated`, "a..b", `a"b"`, `"a"b`, "a.", ".a"}
+	for _, store := range bad {
+		if _, err := tablePath(store, "samples"); err == nil {
+			t.Errorf("tablePath(%q) expected error", store)
+		}
+	}
+}
+
+func TestViewPath(t *testing.T) {
+	got, err := viewPath(`smile."sample aliases"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"smile"."sample aliases"`; got != want {
+		t.Errorf("viewPath = %q, want %q", got, want)
+	}
+	for _, view := range []string{"", "sample_aliases", "smile..v"} {
+		if _, err := viewPath(view); err == nil {
+			t.Errorf("viewPath(%q) expected error", view)
+		}
+	}
+}
+
+func TestInfoSchemaName(t *testing.T) {
+	tests := []struct {
+		store, table, schema, name string
+	}{
+		{`"local-minio".smile`, "samples", "local-minio.smile", "samples"},
+		{`"my.bucket"`, `"odd table"`, "my.bucket", "odd table"},
+		{"space", "folder.t", "space.folder", "t"},
+	}
+	for _, tt := range tests {
+		schema, name, err := infoSchemaName(tt.store, tt.table)
+		if err != nil {
+			t.Errorf("infoSchemaName(%q, %q) returned error: %s", tt.store, tt.table, err)
+			continue
+		}
+		if schema != tt.schema || name != tt.name {
+			t.Errorf("infoSchemaName(%q, %q) = %q, %q, want %q, %q", tt.store, tt.table, schema, name, tt.schema, tt.name)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	tbl := `"local-minio"."smile"."samples"`
+	tests := []struct {
+		got, want string
+	}{
+		{
+			selectStmt(tbl, column{"IGO_REQUEST_ID", "22022_BZ"}),
+			`select * from "local-minio"."smile"."samples" where IGO_REQUEST_ID = '22022_BZ'`,
+		},
+		{
+			deleteStmt(tbl, column{"IGO_REQUEST_ID", "x' or '1'='1"}),
+			`delete from "local-minio"."smile"."samples" where IGO_REQUEST_ID = 'x'' or ''1''=''1'`,
+		},
+		{
+			insertStmt(tbl, []string{"IGO_REQUEST_ID", "CMO_PATIENT_ID"}, []interface{}{"22022_BZ", "O'Brien"}, []interface{}{"22022_CC", `a\b`}),
+			`insert into "local-minio"."smile"."samples" (IGO_REQUEST_ID, CMO_PATIENT_ID) values ('22022_BZ', 'O''Brien'), ('22022_CC', 'a\b')`,
+		},
+		{
+			updateStmt(tbl,
+				[]column{{"IGO_REQUEST_ID", "22022_BZ"}, {"REQUEST_JSON", []byte(`{"investigatorName":"O'Brien"}`)}},
+				[]column{{"IGO_REQUEST_ID", "22022_BZ"}, {"CMO_PATIENT_ID", "C-'X"}}),
+			`update "local-minio"."smile"."samples" set IGO_REQUEST_ID = '22022_BZ', REQUEST_JSON = '{"investigatorName":"O''Brien"}' where IGO_REQUEST_ID = '22022_BZ' and CMO_PATIENT_ID = 'C-''X'`,
+		},
+		{
+			deleteNotInStmt(tbl, []column{{"IGO_REQUEST_ID", "22022_BZ"}}, "IGO_SAMPLE_NAME", []interface{}{"A_1", "O'B_2"}),
+			`delete from "local-minio"."smile"."samples" where IGO_REQUEST_ID = '22022_BZ' and IGO_SAMPLE_NAME not in ('A_1', 'O''B_2')`,
+		},
+		{
+			deleteNotInStmt(tbl, []column{{"IGO_REQUEST_ID", "22022_BZ"}}, "IGO_SAMPLE_NAME", nil),
+			`delete from "local-minio"."smile"."samples" where IGO_REQUEST_ID = '22022_BZ'`,
+		},
+		{
+			deleteInStmt(tbl, "SMILE_PATIENT_ID", []interface{}{"p-1", "p'2"}),
+			`delete from "local-minio"."smile"."samples" where SMILE_PATIENT_ID in ('p-1', 'p''2')`,
+		},
+		{
+			countStmt(tbl, column{"CMO_PATIENT_ID", "C-TX6DNG"}),
+			`select count(*) from "local-minio"."smile"."samples" where CMO_PATIENT_ID = 'C-TX6DNG'`,
+		},
+		{
+			mergeStmt(tbl, []string{"IGO_REQUEST_ID", "IGO_SAMPLE_NAME", "SAMPLE_JSON"}, []string{"IGO_REQUEST_ID", "IGO_SAMPLE_NAME"},
+				[]interface{}{"22022_BZ", "A_1", []byte(`{"n":"O'B"}`)}, []interface{}{"22022_BZ", "A_2", nil}),
+			`merge into "local-minio"."smile"."samples" as t using (values ('22022_BZ', 'A_1', '{"n":"O''B"}'), ('22022_BZ', 'A_2', NULL)) as s(IGO_REQUEST_ID, IGO_SAMPLE_NAME, SAMPLE_JSON)` +
+				` on t.IGO_REQUEST_ID = s.IGO_REQUEST_ID and t.IGO_SAMPLE_NAME = s.IGO_SAMPLE_NAME` +
+				` when matched then update set SAMPLE_JSON = s.SAMPLE_JSON when not matched then insert (IGO_REQUEST_ID, IGO_SAMPLE_NAME, SAMPLE_JSON) values (s.IGO_REQUEST_ID, s.IGO_SAMPLE_NAME, s.SAMPLE_JSON)`,
+		},
+		{
+			createViewStmt(`"smile"."v"`, "select * from "+tbl),
+			`create or replace view "smile"."v" as select * from "local-minio"."smile"."samples"`,
+		},
+		{
+			createTableStmt(tbl, []columnDef{{"VERSION", "INT"}, {"APPLIED_AT", "TIMESTAMP"}}),
+			`create table if not exists "local-minio"."smile"."samples" (VERSION INT, APPLIED_AT TIMESTAMP)`,
+		},
+		{
+			addColumnsStmt(tbl, []columnDef{{"ONCOTREE_CODE", "VARCHAR"}, {"IGO_COMPLETE", "BOOLEAN"}}),
+			`alter table "local-minio"."smile"."samples" add columns (ONCOTREE_CODE VARCHAR, IGO_COMPLETE BOOLEAN)`,
+		},
+		{
+			columnsStmt("local-minio.smile", "O'Brien"),
+			`select COLUMN_NAME, DATA_TYPE from INFORMATION_SCHEMA."COLUMNS" where TABLE_SCHEMA = 'local-minio.smile' and TABLE_NAME = 'O''Brien' order by ORDINAL_POSITION`,
+		},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got  %s\nwant %s", tt.got, tt.want)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	tests := []struct {
+		sizes             []int
+		maxRows, maxBytes int
+		want              string
+	}{
+		{nil, 2, 10, "[]"},
+		{[]int{1, 1, 1, 1, 1}, 2, 0, "[[0 2] [2 4] [4 5]]"},
+		{[]int{4, 4, 4, 4}, 0, 8, "[[0 2] [2 4]]"},
+		{[]int{4, 4, 4, 4}, 0, 9, "[[0 2] [2 4]]"},
+		// a row larger than the limit is a chunk of its own
+		{[]int{2, 20, 2, 2}, 10, 5, "[[0 1] [1 2] [2 4]]"},
+		{[]int{1, 2, 3}, 0, 0, "[[0 3]]"},
+		{[]int{3, 3, 3}, 2, 100, "[[0 2] [2 3]]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(chunks(tt.sizes, tt.maxRows, tt.maxBytes)); got != tt.want {
+			t.Errorf("chunks(%v, %d, %d) = %s, want %s", tt.sizes, tt.maxRows, tt.maxBytes, got, tt.want)
+		}
+	}
+}
+
+func TestRowSize(t *testing.T) {
+	row := []interface{}{"22022_BZ", "O'Brien", nil, 42}
+	var b strings.Builder
+	writeRow(&b, row)
+	if got := rowSize(row); got != len(b.String()) || got != len(`('22022_BZ', 'O''Brien', NULL, 42)`) {
+		t.Errorf("rowSize = %d, want %d", got, len(b.String()))
+	}
+}
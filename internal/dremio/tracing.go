@@ -0,0 +1,33 @@
+package dremio
+
+import (
+	"context"
+	"github.com/mskcc/smile-dremio-gateway/internal/arrowflight"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/mskcc/smile-dremio-gateway/internal/dremio")
+
+// startStatementSpan starts a client span for a statement of the given kind. statement text is
+// left out since it embeds whole request and sample json documents.
+func startStatementSpan(ctx context.Context, kind string, op arrowflight.Operation) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "dremio."+kind, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemKey.String("dremio"),
+		semconv.DBOperation(string(op)),
+	))
+}
+
+// endStatementSpan records the outcome of a statement on span, rows is the number of affected rows or -1 if unknown
+func endStatementSpan(span trace.Span, rows int64, err error) {
+	if rows >= 0 {
+		span.SetAttributes(attribute.Int64("db.rows_affected", rows))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "statement failed")
+	}
+}
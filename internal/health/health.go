@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultCheckTimeout = 5 * time.Second
+	shutdownTimeout     = 5 * time.Second
+)
+
+type HealthArgs struct {
+	// address the http server listens on, e.g. ":8080"
+	Addr string
+	// how long /readyz waits for each check, defaults to defaultCheckTimeout
+	CheckTimeout time.Duration
+}
+
+// Check reports whether a dependency is usable, it is run on every /readyz request
+type Check struct {
+	Name string
+	Fn   func(context.Context) error
+}
+
+// StatusFunc returns the counters rendered by the status page
+type StatusFunc func() interface{}
+
+// Server serves /healthz (the process is alive), /readyz (every check passes),
+// /status (a json page with the counters returned by StatusFunc) and /metrics (prometheus)
+type Server struct {
+	args   HealthArgs
+	status StatusFunc
+	checks []Check
+	start  time.Time
+}
+
+func NewServer(args HealthArgs, status StatusFunc, checks ...Check) (*Server, error) {
+	if args.Addr == "" {
+		return nil, errors.New("address must not be empty")
+	}
+	if status == nil {
+		return nil, errors.New("status must not be nil")
+	}
+	if args.CheckTimeout <= 0 {
+		args.CheckTimeout = defaultCheckTimeout
+	}
+	return &Server{args: args, status: status, checks: checks, start: time.Now()}, nil
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/status", s.statusPage)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// Run serves until ctx is canceled
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.args.Addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: s.args.CheckTimeout}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+	slog.Info("Health server listening", "address", ln.Addr().String())
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyz runs all checks and reports each one's result, failing if any of them fails
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	results := make(map[string]string, len(s.checks))
+	code := http.StatusOK
+	for _, c := range s.checks {
+		ctx, cancel := context.WithTimeout(r.Context(), s.args.CheckTimeout)
+		err := c.Fn(ctx)
+		cancel()
+		if err != nil {
+			results[c.Name] = err.Error()
+			code = http.StatusServiceUnavailable
+			continue
+		}
+		results[c.Name] = "ok"
+	}
+	writeJSON(w, code, results)
+}
+
+func (s *Server) statusPage(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Started  time.Time   `json:"started"`
+		Uptime   string      `json:"uptime"`
+		Messages interface{} `json:"messages"`
+	}{s.start, time.Since(s.start).Round(time.Second).String(), s.status()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Warn("Could not write response", "error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, checks ...Check) *httptest.Server {
+	t.Helper()
+	s, err := NewServer(HealthArgs{Addr: "127.0.0.1:0", CheckTimeout: 50 * time.Millisecond}, func() interface{} {
+		return map[string]int{"received": 3}
+	}, checks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t, Check{"broken", func(context.Context) error { return errors.New("down") }})
+	// liveness does not depend on the checks
+	if code := get(t, ts.URL+"/healthz", nil); code != http.StatusOK {
+		t.Fatalf("/healthz = %d, want 200", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ok := Check{"nats", func(context.Context) error { return nil }}
+	down := Check{"dremio", func(context.Context) error { return errors.New("connection refused") }}
+	slow := Check{"slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	tests := []struct {
+		name     string
+		checks   []Check
+		wantCode int
+		want     map[string]string
+	}{
+		{"no checks", nil, http.StatusOK, map[string]string{}},
+		{"ready", []Check{ok}, http.StatusOK, map[string]string{"nats": "ok"}},
+		{"failing check", []Check{ok, down}, http.StatusServiceUnavailable, map[string]string{"nats": "ok", "dremio": "connection refused"}},
+		{"check times out", []Check{slow}, http.StatusServiceUnavailable, map[string]string{"slow": context.DeadlineExceeded.Error()}},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t, tt.checks...)
+		var got map[string]string
+		if code := get(t, ts.URL+"/readyz", &got); code != tt.wantCode {
+			t.Errorf("%s: /readyz = %d, want %d", tt.name, code, tt.wantCode)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: %s = %q, want %q", tt.name, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestStatusPage(t *testing.T) {
+	ts := newTestServer(t)
+	var got struct {
+		Uptime   string         `json:"uptime"`
+		Messages map[string]int `json:"messages"`
+	}
+	if code := get(t, ts.URL+"/status", &got); code != http.StatusOK {
+		t.Fatalf("/status = %d, want 200", code)
+	}
+	if got.Uptime == "" || got.Messages["received"] != 3 {
+		t.Errorf("unexpected status page %+v", got)
+	}
+}
+
+func TestRunStopsWithContext(t *testing.T) {
+	s, err := NewServer(HealthArgs{Addr: "127.0.0.1:0"}, func() interface{} { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was canceled")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("/metrics = %d, body does not contain the default metrics", resp.StatusCode)
+	}
+}
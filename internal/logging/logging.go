@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// supported values of LogArgs.Format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// keys of the fields that tie log lines to the message being processed
+const (
+	IgoRequestID    = "igo_request_id"
+	SampleName      = "sample_name"
+	CmoSampleName   = "cmo_sample_name"
+	Subject         = "subject"
+	StreamSeq       = "stream_seq"
+	DeliveryAttempt = "delivery_attempt"
+)
+
+type LogArgs struct {
+	// one of debug, info, warn or error, defaults to info
+	Level string
+	// FormatText or FormatJSON, defaults to FormatText
+	Format string
+}
+
+// New returns a logger writing to w as configured by args
+func New(w io.Writer, args LogArgs) (*slog.Logger, error) {
+	var level slog.Level
+	if args.Level != "" {
+		if err := level.UnmarshalText([]byte(args.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q, must be one of debug, info, warn or error", args.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(args.Format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, must be one of text or json", args.Format)
+}
+
+// Setup makes a logger writing to stderr the default, which also routes the log package through it
+func Setup(args LogArgs) error {
+	l, err := New(os.Stderr, args)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+type ctxKey struct{}
+
+// WithLogger returns a copy of ctx carrying l, see FromContext
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx by WithLogger, or the default logger. code
+// handling a message logs through it so every line carries the message's correlation fields.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
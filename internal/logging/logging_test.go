@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		args    LogArgs
+		wantErr bool
+	}{
+		{LogArgs{}, false},
+		{LogArgs{Level: "debug", Format: "json"}, false},
+		{LogArgs{Level: "WARN", Format: "TEXT"}, false},
+		{LogArgs{Level: "verbose"}, true},
+		{LogArgs{Format: "xml"}, true},
+	}
+	for _, tt := range tests {
+		_, err := New(&bytes.Buffer{}, tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%+v) error = %v, want error %t", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJSONCorrelationFields(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, LogArgs{Level: "info", Format: FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = l.With(IgoRequestID, "22022_BZ", StreamSeq, uint64(42))
+	ctx := WithLogger(context.Background(), l)
+	FromContext(ctx).Debug("dropped")
+	FromContext(ctx).Info("processing", Subject, "MDB_STREAM.server-new-request")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1 since debug is below the level: %s", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"msg":        "processing",
+		"level":      "INFO",
+		IgoRequestID: "22022_BZ",
+		StreamSeq:    float64(42),
+		Subject:      "MDB_STREAM.server-new-request",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestFromContextDefault(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("FromContext without a logger did not return the default logger")
+	}
+}
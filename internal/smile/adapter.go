@@ -1,11 +1,38 @@
 package smile
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	nm "github.com/mskcc/nats-messaging-go"
-	"log"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"github.com/nats-io/nats.go"
+	"log/slog"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNakDelay = 30 * time.Second
+	// set by nats-messaging-go on every published message
+	natsSubHeader = "Nats-Msg-Subject"
+)
+
+// headers added to dead lettered messages
+const (
+	HeaderFailureStage     = "Smile-Failure-Stage"
+	HeaderFailureError     = "Smile-Failure-Error"
+	HeaderOriginalSubject  = "Smile-Original-Subject"
+	HeaderDeliveryAttempts = "Smile-Delivery-Attempts"
+)
+
+// values of HeaderFailureStage
+const (
+	StageUnquote    = "unquote"
+	StageUnmarshal  = "unmarshal"
+	StageRepository = "repository"
 )
 
 type SmileArgs struct {
@@ -18,11 +45,29 @@ type SmileArgs struct {
 	NewRequestFilter    string
 	UpdateRequestFilter string
 	UpdateSampleFilter  string
+	// how long jetstream waits before redelivering a message that failed with a transient error
+	NakDelay time.Duration
+	// subject messages that cannot be persisted are republished on, dead lettering is disabled when empty
+	DeadLetterSubject string
+	// upper bound on messages jetstream delivers without them being acked, 0 keeps the durable
+	// consumer's setting. should be at least the total worker and queue capacity in Workers.
+	MaxAckPending int
+	Workers       WorkerArgs
 }
 
 type SmileAdaptor struct {
 	SmileArgs SmileArgs
 	Messaging *nm.Messaging
+	// closed by Stop
+	stopped  chan struct{}
+	stopOnce *sync.Once
+	sub      *subscription
+}
+
+// subscription holds the jetstream subscription, it is shared by all copies of a SmileAdaptor
+type subscription struct {
+	mu  sync.Mutex
+	sub *nats.Subscription
 }
 
 type RequestAdaptor struct {
@@ -39,78 +84,246 @@ func NewSmileAdaptor(sa SmileArgs) (*SmileAdaptor, error) {
 	if sa.URL == "" {
 		return nil, errors.New("url cannot be nil")
 	}
+	if sa.NakDelay == 0 {
+		sa.NakDelay = defaultNakDelay
+	}
 
 	m, err := nm.NewSecureMessaging(sa.URL, sa.CertPath, sa.KeyPath, sa.Consumer, sa.Password)
 	if err != nil {
 		return nil, errors.New("cannot create a messaging connection")
 	}
 
-	return &SmileAdaptor{SmileArgs: sa, Messaging: m}, nil
+	return &SmileAdaptor{SmileArgs: sa, Messaging: m, stopped: make(chan struct{}), stopOnce: &sync.Once{}, sub: &subscription{}}, nil
 }
 
 func (s SmileAdaptor) SubscribeSmileConsumer(newRequestCh chan RequestAdaptor, upRequestCh chan RequestAdaptor, upSampleCh chan SampleAdaptor) error {
-	err := s.Messaging.Subscribe(s.SmileArgs.Consumer, s.SmileArgs.Subject, func(m *nm.Msg) {
+	return s.subscribe(s.handler(newRequestCh, upRequestCh, upSampleCh))
+}
+
+// handler decodes messages and routes them to the channel of the filter subject they match
+func (s SmileAdaptor) handler(newRequestCh chan RequestAdaptor, upRequestCh chan RequestAdaptor, upSampleCh chan SampleAdaptor) nm.MsgHandler {
+	return func(m *nm.Msg) {
 		switch {
 		case m.Subject == s.SmileArgs.NewRequestFilter:
+			messagesReceived.WithLabelValues(m.Subject).Inc()
 			var r Request
-			su, err := strconv.Unquote(string(m.Data))
-			if err != nil {
-				log.Println("Error unmarshaling Request: ", err)
+			if stage, err := decode(m, &r); err != nil {
+				slog.With(logAttrs(m)...).Warn("Could not decode request", "stage", stage, "error", err)
+				s.reject(m, stage, err)
 			} else {
-				err = json.Unmarshal([]byte(su), &r)
-				if err != nil {
-					log.Println("Error unmarshaling Request: ", err)
-				} else {
-					reqs := []Request{r}
-					ra := RequestAdaptor{reqs, m}
-					newRequestCh <- ra
+				reqs := []Request{r}
+				ra := RequestAdaptor{reqs, m}
+				select {
+				case newRequestCh <- ra:
+				case <-s.stopped:
+					s.nak(m)
 				}
 			}
-			break
 		case m.Subject == s.SmileArgs.UpdateRequestFilter:
+			messagesReceived.WithLabelValues(m.Subject).Inc()
 			var r []Request
-			su, err := strconv.Unquote(string(m.Data))
-			if err != nil {
-				log.Println("Error unmarshaling Request: ", err)
+			if stage, err := decode(m, &r); err != nil {
+				slog.With(logAttrs(m)...).Warn("Could not decode request", "stage", stage, "error", err)
+				s.reject(m, stage, err)
+			} else if len(r) == 0 {
+				s.reject(m, StageUnmarshal, errors.New("message contains no requests"))
 			} else {
-				err := json.Unmarshal([]byte(su), &r)
-				if err != nil {
-					log.Println("Error unmarshaling Request: ", err)
-				} else {
-					ra := RequestAdaptor{r, m}
-					upRequestCh <- ra
+				ra := RequestAdaptor{r, m}
+				select {
+				case upRequestCh <- ra:
+				case <-s.stopped:
+					s.nak(m)
 				}
 			}
-			break
 		case m.Subject == s.SmileArgs.UpdateSampleFilter:
-			var s []Sample
-			su, err := strconv.Unquote(string(m.Data))
-			if err != nil {
-				log.Println("Error unmarshaling Request: ", err)
+			messagesReceived.WithLabelValues(m.Subject).Inc()
+			var smp []Sample
+			if stage, err := decode(m, &smp); err != nil {
+				slog.With(logAttrs(m)...).Warn("Could not decode sample", "stage", stage, "error", err)
+				s.reject(m, stage, err)
+			} else if len(smp) == 0 {
+				s.reject(m, StageUnmarshal, errors.New("message contains no samples"))
 			} else {
-				err := json.Unmarshal([]byte(su), &s)
-				if err != nil {
-					log.Println("Error unmarshaling Sample: ", err)
-				} else {
-					sa := SampleAdaptor{s, m}
-					upSampleCh <- sa
+				sa := SampleAdaptor{smp, m}
+				select {
+				case upSampleCh <- sa:
+				case <-s.stopped:
+					s.nak(m)
 				}
 			}
-			break
 		default:
 			// not interested in message, Ack it so we don't get it again
 			m.ProviderMsg.Ack()
 		}
-	})
+	}
+}
+
+// subscribe registers mh with the durable consumer, limiting unacked deliveries when MaxAckPending is set.
+// this mirrors nm.Messaging.Subscribe, which does not return the subscription.
+func (s SmileAdaptor) subscribe(mh nm.MsgHandler) error {
+	opts := []nats.SubOpt{nats.Durable(s.SmileArgs.Consumer), nats.ManualAck()}
+	if s.SmileArgs.MaxAckPending > 0 {
+		opts = append(opts, nats.MaxAckPending(s.SmileArgs.MaxAckPending))
+	}
+	sub, err := s.Messaging.Js.Subscribe(s.SmileArgs.Subject, func(m *nats.Msg) {
+		mh(&nm.Msg{Subject: m.Subject, Data: m.Data, ProviderMsg: m})
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	s.sub.mu.Lock()
+	defer s.sub.mu.Unlock()
+	s.sub.sub = sub
+	return nil
+}
+
+// Ready reports whether messages are being consumed, that is the subscription is active,
+// the service has not been stopped and jetstream answers requests
+func (s SmileAdaptor) Ready(ctx context.Context) error {
+	select {
+	case <-s.stopped:
+		return errors.New("consumer is shutting down")
+	default:
+	}
+	s.sub.mu.Lock()
+	sub := s.sub.sub
+	s.sub.mu.Unlock()
+	if sub == nil || !sub.IsValid() {
+		return errors.New("not subscribed to " + s.SmileArgs.Subject)
+	}
+	_, err := s.Messaging.Js.AccountInfo(nats.Context(ctx))
 	return err
 }
 
+// logAttrs returns the correlation fields of m for logging
+func logAttrs(m *nm.Msg) []interface{} {
+	if m == nil {
+		return nil
+	}
+	attrs := []interface{}{logging.Subject, m.Subject}
+	if m.ProviderMsg == nil {
+		return attrs
+	}
+	if md, err := m.ProviderMsg.Metadata(); err == nil {
+		attrs = append(attrs, logging.StreamSeq, md.Sequence.Stream, logging.DeliveryAttempt, md.NumDelivered)
+	}
+	return attrs
+}
+
+// decode unquotes the message payload and unmarshals it into v, on failure it
+// returns the stage that failed
+func decode(m *nm.Msg, v interface{}) (string, error) {
+	su, err := strconv.Unquote(string(m.Data))
+	if err != nil {
+		return StageUnquote, err
+	}
+	if err := json.Unmarshal([]byte(su), v); err != nil {
+		return StageUnmarshal, err
+	}
+	return "", nil
+}
+
+// reject dead letters a message that can never be processed
+func (s SmileAdaptor) reject(m *nm.Msg, stage string, err error) {
+	if dlErr := s.deadLetter(m, stage, err); dlErr != nil {
+		slog.With(logAttrs(m)...).Error("Could not dead letter message, will retry", "error", dlErr)
+		s.nak(m)
+	}
+}
+
+// deadLetter republishes the original payload of m on SmileArgs.DeadLetterSubject, with headers
+// describing why it failed, and acks m. m is discarded when no dead letter subject is configured.
+// it is counted as failed rather than acked, messagesAcked only counts persisted messages.
+func (s SmileAdaptor) deadLetter(m *nm.Msg, stage string, cause error) error {
+	if s.SmileArgs.DeadLetterSubject == "" {
+		messagesFailed.WithLabelValues(m.Subject, reasonDiscarded).Inc()
+	} else {
+		if _, err := s.Messaging.Js.PublishMsg(deadLetterMsg(s.SmileArgs.DeadLetterSubject, m, stage, cause)); err != nil {
+			return err
+		}
+		messagesFailed.WithLabelValues(m.Subject, reasonDeadLetter).Inc()
+	}
+	m.ProviderMsg.Ack()
+	return nil
+}
+
+// deadLetterMsg builds the dead letter of m for subject. the headers of m, such as its trace
+// context and message id, are carried over so the dead letter can be traced back to it.
+func deadLetterMsg(subject string, m *nm.Msg, stage string, cause error) *nats.Msg {
+	dm := nats.NewMsg(subject)
+	dm.Data = m.Data
+	if m.ProviderMsg != nil {
+		for k, v := range m.ProviderMsg.Header {
+			dm.Header[k] = append([]string(nil), v...)
+		}
+	}
+	dm.Header.Set(natsSubHeader, subject)
+	dm.Header.Set(HeaderFailureStage, stage)
+	dm.Header.Set(HeaderFailureError, cause.Error())
+	dm.Header.Set(HeaderOriginalSubject, m.Subject)
+	if m.ProviderMsg != nil {
+		if md, err := m.ProviderMsg.Metadata(); err == nil {
+			dm.Header.Set(HeaderDeliveryAttempts, strconv.FormatUint(md.NumDelivered, 10))
+		}
+	}
+	return dm
+}
+
+// SubjectMatches reports whether subject is matched by filter, a nats subject that may contain
+// the * and > wildcards
+func SubjectMatches(filter, subject string) bool {
+	f, t := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, tok := range f {
+		if tok == ">" {
+			return len(t) > i
+		}
+		if i >= len(t) || (tok != "*" && tok != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// DeadLetterRequest publishes a request message that failed permanently in the repository and acks it
+func (s SmileAdaptor) DeadLetterRequest(ra RequestAdaptor, err error) error {
+	return s.deadLetter(ra.Msg, StageRepository, err)
+}
+
+// DeadLetterSample publishes a sample message that failed permanently in the repository and acks it
+func (s SmileAdaptor) DeadLetterSample(sa SampleAdaptor, err error) error {
+	return s.deadLetter(sa.Msg, StageRepository, err)
+}
+
 func (s SmileAdaptor) AckRequest(ra RequestAdaptor) {
 	ra.Msg.ProviderMsg.Ack()
+	messagesAcked.WithLabelValues(ra.Msg.Subject).Inc()
 }
 
 func (s SmileAdaptor) AckSample(sa SampleAdaptor) {
 	sa.Msg.ProviderMsg.Ack()
+	messagesAcked.WithLabelValues(sa.Msg.Subject).Inc()
+}
+
+// NakRequest asks jetstream to redeliver the message after SmileArgs.NakDelay
+func (s SmileAdaptor) NakRequest(ra RequestAdaptor) {
+	s.nak(ra.Msg)
+}
+
+// NakSample asks jetstream to redeliver the message after SmileArgs.NakDelay
+func (s SmileAdaptor) NakSample(sa SampleAdaptor) {
+	s.nak(sa.Msg)
+}
+
+func (s SmileAdaptor) nak(m *nm.Msg) {
+	m.ProviderMsg.NakWithDelay(s.SmileArgs.NakDelay)
+	messagesFailed.WithLabelValues(m.Subject, reasonNak).Inc()
+}
+
+// Stop stops handing messages to the service, messages delivered from now on are NAKed so
+// jetstream redelivers them. the subscription itself is kept since unsubscribing deletes a
+// durable consumer that was created by the client library.
+func (s SmileAdaptor) Stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
 }
 
 func (s SmileAdaptor) Shutdown() {
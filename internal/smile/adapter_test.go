@@ -0,0 +1,177 @@
+package smile
+
+import (
+	"errors"
+	nm "github.com/mskcc/nats-messaging-go"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const (
+	newRequestSubject    = "MDB_STREAM.server-new-request"
+	updateRequestSubject = "MDB_STREAM.server-update-request"
+	updateSampleSubject  = "MDB_STREAM.server-update-sample"
+)
+
+func testMsg(subject, data string) *nm.Msg {
+	pm := nats.NewMsg(subject)
+	pm.Data = []byte(data)
+	return &nm.Msg{Subject: subject, Data: pm.Data, ProviderMsg: pm}
+}
+
+func TestHandlerRoutesFilterSubjects(t *testing.T) {
+	s := SmileAdaptor{
+		SmileArgs: SmileArgs{
+			NewRequestFilter:    newRequestSubject,
+			UpdateRequestFilter: updateRequestSubject,
+			UpdateSampleFilter:  updateSampleSubject,
+		},
+		stopped:  make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+	tests := []struct {
+		name    string
+		subject string
+		data    string
+		// the channel the message is routed to and the id it carries, empty when it is rejected
+		wantCh string
+		wantID string
+	}{
+		{"new request", newRequestSubject, strconv.Quote(`{"igoRequestId":"22022_BZ"}`), "newRequest", "22022_BZ"},
+		{"update request", updateRequestSubject, strconv.Quote(`[{"igoRequestId":"22022_CA"},{"igoRequestId":"22022_BZ"}]`), "upRequest", "22022_CA"},
+		{"update sample", updateSampleSubject, strconv.Quote(`[{"primaryId":"22022_BZ_1"}]`), "upSample", "22022_BZ_1"},
+		{"payload not quoted", newRequestSubject, `{"igoRequestId":"22022_BZ"}`, "", ""},
+		{"payload not json", updateRequestSubject, strconv.Quote(`not json`), "", ""},
+		{"no requests", updateRequestSubject, strconv.Quote(`[]`), "", ""},
+		{"no samples", updateSampleSubject, strconv.Quote(`[]`), "", ""},
+		{"other subject", "MDB_STREAM.server-other", strconv.Quote(`{}`), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRequestCh := make(chan RequestAdaptor, 1)
+			upRequestCh := make(chan RequestAdaptor, 1)
+			upSampleCh := make(chan SampleAdaptor, 1)
+			discarded := testutil.ToFloat64(messagesFailed.WithLabelValues(tt.subject, reasonDiscarded))
+
+			s.handler(newRequestCh, upRequestCh, upSampleCh)(testMsg(tt.subject, tt.data))
+
+			got := map[string]string{}
+			select {
+			case ra := <-newRequestCh:
+				got["newRequest"] = ra.Requests[0].IgoRequestID
+			case ra := <-upRequestCh:
+				got["upRequest"] = ra.Requests[0].IgoRequestID
+			case sa := <-upSampleCh:
+				got["upSample"] = sa.Samples[0].PrimaryID
+			default:
+			}
+			if tt.wantCh != "" {
+				if len(got) != 1 || got[tt.wantCh] != tt.wantID {
+					t.Errorf("routed %v, want %s to %s", got, tt.wantID, tt.wantCh)
+				}
+				return
+			}
+			if len(got) != 0 {
+				t.Errorf("routed %v, want the message rejected", got)
+			}
+			// without a dead letter subject rejected messages of the filter subjects are discarded
+			wantDiscarded := 1.0
+			if tt.subject == "MDB_STREAM.server-other" {
+				wantDiscarded = 0
+			}
+			if n := testutil.ToFloat64(messagesFailed.WithLabelValues(tt.subject, reasonDiscarded)) - discarded; n != wantDiscarded {
+				t.Errorf("discarded %v messages, want %v", n, wantDiscarded)
+			}
+		})
+	}
+}
+
+func TestHandlerNaksAfterStop(t *testing.T) {
+	s := SmileAdaptor{
+		SmileArgs: SmileArgs{NewRequestFilter: newRequestSubject},
+		stopped:   make(chan struct{}),
+		stopOnce:  &sync.Once{},
+	}
+	s.Stop()
+	naked := testutil.ToFloat64(messagesFailed.WithLabelValues(newRequestSubject, reasonNak))
+	// nothing reads the channel, the handler must not block on it once stopped
+	s.handler(make(chan RequestAdaptor), nil, nil)(testMsg(newRequestSubject, strconv.Quote(`{"igoRequestId":"22022_BZ"}`)))
+	if n := testutil.ToFloat64(messagesFailed.WithLabelValues(newRequestSubject, reasonNak)) - naked; n != 1 {
+		t.Errorf("NAKed %v messages, want 1", n)
+	}
+}
+
+func TestDeadLetterIsNotCountedAsAcked(t *testing.T) {
+	s := SmileAdaptor{}
+	ra := RequestAdaptor{Msg: testMsg(newRequestSubject, strconv.Quote(`{"igoRequestId":"22022_BZ"}`))}
+	acked := testutil.ToFloat64(messagesAcked.WithLabelValues(newRequestSubject))
+	discarded := testutil.ToFloat64(messagesFailed.WithLabelValues(newRequestSubject, reasonDiscarded))
+
+	if err := s.DeadLetterRequest(ra, errors.New("syntax error")); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(messagesAcked.WithLabelValues(newRequestSubject)) - acked; n != 0 {
+		t.Errorf("counted %v dead lettered messages as acked, want 0", n)
+	}
+	if n := testutil.ToFloat64(messagesFailed.WithLabelValues(newRequestSubject, reasonDiscarded)) - discarded; n != 1 {
+		t.Errorf("counted %v failed messages, want 1", n)
+	}
+	s.AckRequest(ra)
+	if n := testutil.ToFloat64(messagesAcked.WithLabelValues(newRequestSubject)) - acked; n != 1 {
+		t.Errorf("counted %v persisted messages as acked, want 1", n)
+	}
+}
+
+func TestDeadLetterMsg(t *testing.T) {
+	m := testMsg(newRequestSubject, strconv.Quote(`{"igoRequestId":"22022_BZ"}`))
+	m.ProviderMsg.Header.Set(natsSubHeader, newRequestSubject)
+	m.ProviderMsg.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	m.ProviderMsg.Header.Set(nats.MsgIdHdr, "msg-1")
+
+	dm := deadLetterMsg("DLQ.gateway", m, StageRepository, errors.New("value too long"))
+	want := map[string]string{
+		natsSubHeader:         "DLQ.gateway",
+		"traceparent":         "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		nats.MsgIdHdr:         "msg-1",
+		HeaderFailureStage:    StageRepository,
+		HeaderFailureError:    "value too long",
+		HeaderOriginalSubject: newRequestSubject,
+	}
+	for k, v := range want {
+		if got := dm.Header.Get(k); got != v {
+			t.Errorf("header %s = %q, want %q", k, got, v)
+		}
+	}
+	if dm.Subject != "DLQ.gateway" || string(dm.Data) != string(m.Data) {
+		t.Errorf("dead letter on %s with %s, want the original payload on DLQ.gateway", dm.Subject, dm.Data)
+	}
+	// the original message keeps its headers
+	if got := m.ProviderMsg.Header.Get(natsSubHeader); got != newRequestSubject {
+		t.Errorf("original %s header changed to %q", natsSubHeader, got)
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	tests := []struct {
+		filter, subject string
+		want            bool
+	}{
+		{"MDB_STREAM.>", "MDB_STREAM.dead-letter", true},
+		{"MDB_STREAM.>", "MDB_STREAM.a.b", true},
+		{"MDB_STREAM.>", "MDB_STREAM", false},
+		{"MDB_STREAM.*", "MDB_STREAM.dead-letter", true},
+		{"MDB_STREAM.*", "MDB_STREAM.a.b", false},
+		{"MDB_STREAM.*.x", "MDB_STREAM.a.x", true},
+		{"MDB_STREAM.server-new-request", "MDB_STREAM.server-new-request", true},
+		{"MDB_STREAM.server-new-request", "MDB_STREAM.server", false},
+		{"MDB_STREAM.>", "DLQ.gateway", false},
+	}
+	for _, tt := range tests {
+		if got := SubjectMatches(tt.filter, tt.subject); got != tt.want {
+			t.Errorf("SubjectMatches(%q, %q) = %v, want %v", tt.filter, tt.subject, got, tt.want)
+		}
+	}
+}
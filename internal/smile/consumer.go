@@ -3,19 +3,40 @@ package smile
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	requestBufSize = 1
-	sampleBufSize  = 1
+	defaultWorkers   = 4
+	defaultQueueSize = 16
+	// kubernetes sends SIGKILL 30 seconds after SIGTERM by default
+	defaultShutdownGracePeriod = 25 * time.Second
+	// the channels are unbuffered so messages reach Run in the order they were delivered,
+	// with buffering a select over several ready channels could reorder them
+	requestBufSize = 0
+	sampleBufSize  = 0
 )
 
 type SmileSubscriber interface {
 	SubscribeSmileConsumer(newRequestCh chan RequestAdaptor, upRequestCh chan RequestAdaptor, upSampleCh chan SampleAdaptor) error
 	AckRequest(ra RequestAdaptor)
 	AckSample(sa SampleAdaptor)
+	NakRequest(ra RequestAdaptor)
+	NakSample(sa SampleAdaptor)
+	// DeadLetterRequest and DeadLetterSample ack the message once it is dead lettered
+	DeadLetterRequest(ra RequestAdaptor, err error) error
+	DeadLetterSample(sa SampleAdaptor, err error) error
+	// Stop stops handing messages to the service, Shutdown closes the connection
+	Stop()
 	Shutdown()
 }
 
@@ -23,26 +44,110 @@ type Repository interface {
 	AddRequest(context.Context, Request) error
 	UpdateRequest(context.Context, []Request) error
 	UpdateSample(context.Context, []Sample) error
+	Close() error
+}
+
+// WorkerArgs bounds how many messages of each type are processed at once and how many more
+// may wait for a worker, every type has workers and a queue of its own. once both are used up
+// for a type no further messages are taken from jetstream. zero values fall back to the defaults above.
+type WorkerArgs struct {
+	AddRequestWorkers      int
+	AddRequestQueueSize    int
+	UpdateRequestWorkers   int
+	UpdateRequestQueueSize int
+	SampleWorkers          int
+	SampleQueueSize        int
+	// how long Run waits for messages being processed to finish on shutdown
+	ShutdownGracePeriod time.Duration
 }
 
 type Service struct {
-	smile SmileSubscriber
-	repo  Repository
+	smile         SmileSubscriber
+	repo          Repository
+	args          WorkerArgs
+	addRequest    *limiter
+	updateRequest *limiter
+	sample        *limiter
+
+	mu    sync.Mutex
+	stats map[string]*MessageStats
+}
+
+// message types reported by Status
+const (
+	MsgAddRequest    = "addRequest"
+	MsgUpdateRequest = "updateRequest"
+	MsgUpdateSample  = "updateSample"
+)
+
+// MessageStats counts what happened to the messages of one type
+type MessageStats struct {
+	Received int64 `json:"received"`
+	// persisted and acked, dead lettered messages are acked but counted as DeadLettered only
+	Acked        int64 `json:"acked"`
+	Naked        int64 `json:"naked"`
+	DeadLettered int64 `json:"deadLettered"`
+	// NAKed because of a shutdown
+	Abandoned     int64      `json:"abandoned"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
 }
 
-func NewService(smile SmileSubscriber, repo Repository) (*Service, error) {
+func NewService(smile SmileSubscriber, repo Repository, args WorkerArgs) (*Service, error) {
 	if smile == nil {
 		return nil, errors.New("SmileSubscriber must not be nil")
 	}
 	if repo == nil {
 		return nil, errors.New("Repository must not be nil")
 	}
-	return &Service{smile: smile, repo: repo}, nil
+	if args.AddRequestWorkers < 0 || args.AddRequestQueueSize < 0 || args.UpdateRequestWorkers < 0 || args.UpdateRequestQueueSize < 0 ||
+		args.SampleWorkers < 0 || args.SampleQueueSize < 0 {
+		return nil, errors.New("worker counts and queue sizes must not be negative")
+	}
+	if args.ShutdownGracePeriod < 0 {
+		return nil, errors.New("shutdown grace period must not be negative")
+	}
+	if args.AddRequestWorkers == 0 {
+		args.AddRequestWorkers = defaultWorkers
+	}
+	if args.AddRequestQueueSize == 0 {
+		args.AddRequestQueueSize = defaultQueueSize
+	}
+	if args.UpdateRequestWorkers == 0 {
+		args.UpdateRequestWorkers = defaultWorkers
+	}
+	if args.UpdateRequestQueueSize == 0 {
+		args.UpdateRequestQueueSize = defaultQueueSize
+	}
+	if args.SampleWorkers == 0 {
+		args.SampleWorkers = defaultWorkers
+	}
+	if args.SampleQueueSize == 0 {
+		args.SampleQueueSize = defaultQueueSize
+	}
+	if args.ShutdownGracePeriod == 0 {
+		args.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	return &Service{
+		smile:         smile,
+		repo:          repo,
+		args:          args,
+		addRequest:    newLimiter(args.AddRequestWorkers, args.AddRequestQueueSize),
+		updateRequest: newLimiter(args.UpdateRequestWorkers, args.UpdateRequestQueueSize),
+		sample:        newLimiter(args.SampleWorkers, args.SampleQueueSize),
+		stats: map[string]*MessageStats{
+			MsgAddRequest:    {},
+			MsgUpdateRequest: {},
+			MsgUpdateSample:  {},
+		},
+	}, nil
 }
 
+// Run processes messages until ctx is canceled. it then stops taking messages, gives the ones
+// being processed ShutdownGracePeriod to finish and NAKs the rest so they are redelivered.
 func (svc *Service) Run(ctx context.Context) error {
 
-	log.Println("Starting up SMILE consumer...")
+	slog.Info("Starting up SMILE consumer...")
 	newRequestCh := make(chan RequestAdaptor, requestBufSize)
 	updateRequestCh := make(chan RequestAdaptor, requestBufSize)
 	updateSampleCh := make(chan SampleAdaptor, sampleBufSize)
@@ -50,60 +155,237 @@ func (svc *Service) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	log.Println("SMILE consumer running...")
+	slog.Info("SMILE consumer running...")
 
-	var nrwg sync.WaitGroup
-	var urwg sync.WaitGroup
-	var uswg sync.WaitGroup
+	// repository calls outlive ctx so in flight messages can finish during the grace period
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	// work on the same igo request is serialized, unrelated requests are processed concurrently
+	// by the workers of their message type. Dispatch blocks while those are saturated, which in
+	// turn blocks the subscription so no more messages are taken from jetstream. it gives up
+	// once ctx is canceled so shutdown is not held up by a full queue.
+	d := newKeyedDispatcher()
 	for {
 		select {
 		case ra := <-newRequestCh:
-			nrwg.Add(1)
-			log.Printf("Processing add request: %s\n", ra.Requests[0].IgoRequestID)
-			go func() {
-				defer nrwg.Done()
-				err := svc.repo.AddRequest(ctx, ra.Requests[0])
-				if err != nil {
-					log.Println("Error adding request: ", err)
-				}
-				// if we don't ack, we will keep getting message
-				svc.smile.AckRequest(ra)
-			}()
-			log.Println("Processing add request complete")
+			mctx, logger := startMessageSpan(workCtx, MsgAddRequest, ra.Msg, requestLogger(ra),
+				attribute.String(logging.IgoRequestID, ra.Requests[0].IgoRequestID))
+			logger.Info("Processing add request")
+			svc.dispatch(ctx, d, requestKey(ra.Requests[0]), svc.addRequest, mctx, svc.requestJob(MsgAddRequest, "adding request", ra, func(ctx context.Context) error {
+				return svc.repo.AddRequest(ctx, ra.Requests[0])
+			}))
 		case ra := <-updateRequestCh:
-			urwg.Add(1)
-			log.Printf("Processing update request: %s\n", ra.Requests[0].IgoRequestID)
-			go func() {
-				defer urwg.Done()
-				err := svc.repo.UpdateRequest(ctx, ra.Requests)
-				if err != nil {
-					log.Println("Error updating request: ", err)
-				}
-				// if we don't ack, we will keep getting message
-				svc.smile.AckRequest(ra)
-			}()
-			log.Println("Processing update request complete")
+			mctx, logger := startMessageSpan(workCtx, MsgUpdateRequest, ra.Msg, requestLogger(ra),
+				attribute.String(logging.IgoRequestID, ra.Requests[0].IgoRequestID))
+			logger.Info("Processing update request")
+			svc.dispatch(ctx, d, requestKey(ra.Requests[0]), svc.updateRequest, mctx, svc.requestJob(MsgUpdateRequest, "updating request", ra, func(ctx context.Context) error {
+				return svc.repo.UpdateRequest(ctx, ra.Requests)
+			}))
 		case sa := <-updateSampleCh:
-			uswg.Add(1)
-			log.Printf("Processing update sample: %s\n", sa.Samples[0].CmoSampleName)
+			mctx, logger := startMessageSpan(workCtx, MsgUpdateSample, sa.Msg, sampleLogger(sa),
+				attribute.String(logging.IgoRequestID, sa.Samples[0].AdditionalProperties.IgoRequestID),
+				attribute.String(logging.SampleName, sa.Samples[0].SampleName))
+			logger.Info("Processing update sample")
+			svc.dispatch(ctx, d, sampleKey(sa.Samples[0]), svc.sample, mctx, svc.sampleJob(MsgUpdateSample, "updating sample", sa, func(ctx context.Context) error {
+				return svc.repo.UpdateSample(ctx, sa.Samples)
+			}))
+		case <-ctx.Done():
+			slog.Info("Context canceled, shutting down...")
+			svc.smile.Stop()
+			drained := make(chan struct{})
 			go func() {
-				defer uswg.Done()
-				err := svc.repo.UpdateSample(ctx, sa.Samples)
-				if err != nil {
-					log.Println("Error updating sample: ", err)
-				}
-				// if we don't ack, we will keep getting message
-				svc.smile.AckSample(sa)
+				d.Wait()
+				close(drained)
 			}()
-			log.Println("Processing update sample complete")
-		case <-ctx.Done():
-			log.Println("Context canceled, returning...")
-			// tbd: check for messages being processed
-			nrwg.Wait()
-			urwg.Wait()
-			uswg.Wait()
+			select {
+			case <-drained:
+			case <-time.After(svc.args.ShutdownGracePeriod):
+				slog.Warn("Messages still in flight after grace period, abandoning them", "grace_period", svc.args.ShutdownGracePeriod)
+				cancelWork()
+				<-drained
+			}
+			svc.logAbandoned()
 			svc.smile.Shutdown()
+			if err := svc.repo.Close(); err != nil {
+				slog.Error("Could not close repository", "error", err)
+			}
 			return nil
 		}
 	}
 }
+
+// dispatch hands j to d to be processed with jobCtx under key. if ctx is canceled while lim has no
+// room for it, the message of j is NAKed and counted as abandoned instead.
+func (svc *Service) dispatch(ctx context.Context, d *keyedDispatcher, key string, lim *limiter, jobCtx context.Context, j job) {
+	messagesQueued.WithLabelValues(j.msgType).Inc()
+	if d.Dispatch(ctx, key, lim, func() { svc.process(jobCtx, j) }) {
+		return
+	}
+	messagesQueued.WithLabelValues(j.msgType).Dec()
+	j.nak()
+	span := trace.SpanFromContext(jobCtx)
+	span.SetAttributes(attrOutcome.String(outcomeAbandoned))
+	span.End()
+	svc.count(j.msgType, func(st *MessageStats) {
+		st.Received++
+		st.Abandoned++
+	})
+}
+
+// job is a single message to process, along with how to settle it with jetstream
+type job struct {
+	msgType    string
+	op         string
+	run        func(context.Context) error
+	ack        func()
+	nak        func()
+	deadLetter func(error) error
+}
+
+func (svc *Service) requestJob(msgType, op string, ra RequestAdaptor, run func(context.Context) error) job {
+	return job{
+		msgType:    msgType,
+		op:         op,
+		run:        run,
+		ack:        func() { svc.smile.AckRequest(ra) },
+		nak:        func() { svc.smile.NakRequest(ra) },
+		deadLetter: func(err error) error { return svc.smile.DeadLetterRequest(ra, err) },
+	}
+}
+
+func (svc *Service) sampleJob(msgType, op string, sa SampleAdaptor, run func(context.Context) error) job {
+	return job{
+		msgType:    msgType,
+		op:         op,
+		run:        run,
+		ack:        func() { svc.smile.AckSample(sa) },
+		nak:        func() { svc.smile.NakSample(sa) },
+		deadLetter: func(err error) error { return svc.smile.DeadLetterSample(sa, err) },
+	}
+}
+
+// process runs j and acks, NAKs or dead letters its message depending on the outcome.
+// once ctx is canceled by a shutdown, unfinished messages are NAKed and counted as abandoned.
+// the message span started by startMessageSpan ends with it.
+func (svc *Service) process(ctx context.Context, j job) {
+	messagesQueued.WithLabelValues(j.msgType).Dec()
+	messagesInFlight.WithLabelValues(j.msgType).Inc()
+	defer messagesInFlight.WithLabelValues(j.msgType).Dec()
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+	svc.count(j.msgType, func(st *MessageStats) { st.Received++ })
+	if ctx.Err() != nil {
+		// never started, leave it to whoever consumes next
+		j.nak()
+		span.SetAttributes(attrOutcome.String(outcomeAbandoned))
+		svc.count(j.msgType, func(st *MessageStats) { st.Abandoned++ })
+		return
+	}
+	logger := logging.FromContext(ctx)
+	err := j.run(ctx)
+	if err != nil {
+		reportError(logger, j.op, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, j.op+" failed")
+		now := time.Now()
+		svc.count(j.msgType, func(st *MessageStats) {
+			st.LastError = err.Error()
+			st.LastErrorTime = &now
+		})
+	}
+	if err != nil && ctx.Err() != nil {
+		j.nak()
+		span.SetAttributes(attrOutcome.String(outcomeAbandoned))
+		svc.count(j.msgType, func(st *MessageStats) { st.Abandoned++ })
+		return
+	}
+	if isTransient(err) {
+		// retries are exhausted, have the message redelivered later
+		j.nak()
+		span.SetAttributes(attrOutcome.String(outcomeNak))
+		svc.count(j.msgType, func(st *MessageStats) { st.Naked++ })
+		return
+	}
+	if err != nil {
+		if dlErr := j.deadLetter(err); dlErr != nil {
+			// don't lose the message, try again later
+			logger.Error("Could not dead letter message", "error", dlErr)
+			j.nak()
+			span.SetAttributes(attrOutcome.String(outcomeNak))
+			svc.count(j.msgType, func(st *MessageStats) { st.Naked++ })
+			return
+		}
+		span.SetAttributes(attrOutcome.String(outcomeDeadLetter))
+		svc.count(j.msgType, func(st *MessageStats) { st.DeadLettered++ })
+		return
+	}
+	span.SetAttributes(attrOutcome.String(outcomeAck))
+	// if we don't ack, we will keep getting message
+	j.ack()
+	svc.count(j.msgType, func(st *MessageStats) { st.Acked++ })
+}
+
+// count applies fn to the stats of msgType
+func (svc *Service) count(msgType string, fn func(*MessageStats)) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	fn(svc.stats[msgType])
+}
+
+// Status returns a snapshot of the stats of every message type
+func (svc *Service) Status() map[string]MessageStats {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	status := make(map[string]MessageStats, len(svc.stats))
+	for msgType, st := range svc.stats {
+		status[msgType] = *st
+	}
+	return status
+}
+
+// logAbandoned summarizes the messages that were NAKed because of the shutdown
+func (svc *Service) logAbandoned() {
+	var types []string
+	var total int64
+	for msgType, st := range svc.Status() {
+		if st.Abandoned > 0 {
+			types = append(types, fmt.Sprintf("%s: %d", msgType, st.Abandoned))
+			total += st.Abandoned
+		}
+	}
+	if total == 0 {
+		slog.Info("Shutdown complete, all in flight messages were processed")
+		return
+	}
+	sort.Strings(types)
+	slog.Warn("Shutdown abandoned messages, they were NAKed for redelivery", "total", total, "by_type", strings.Join(types, ", "))
+}
+
+// reportError logs a failed repository operation, calling out operations that timed out
+func reportError(logger *slog.Logger, op string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Error("Timed out "+op, "error", err)
+		return
+	}
+	logger.Error("Error "+op, "error", err, "transient", isTransient(err))
+}
+
+// requestLogger returns a logger carrying the correlation fields of ra
+func requestLogger(ra RequestAdaptor) *slog.Logger {
+	return slog.With(logAttrs(ra.Msg)...).With(logging.IgoRequestID, ra.Requests[0].IgoRequestID)
+}
+
+// sampleLogger returns a logger carrying the correlation fields of sa
+func sampleLogger(sa SampleAdaptor) *slog.Logger {
+	s := sa.Samples[0]
+	return slog.With(logAttrs(sa.Msg)...).With(
+		logging.IgoRequestID, s.AdditionalProperties.IgoRequestID,
+		logging.SampleName, s.SampleName,
+		logging.CmoSampleName, s.CmoSampleName)
+}
+
+// isTransient reports whether err, or an error it wraps, was marked transient by the repository
+func isTransient(err error) bool {
+	var t interface{ Transient() bool }
+	return errors.As(err, &t) && t.Transient()
+}
@@ -0,0 +1,349 @@
+package smile_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	nm "github.com/mskcc/nats-messaging-go"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile/smiletest"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startService runs a service on sub and repo until the returned stop func is called,
+// stop returns what Run returned
+func startService(t *testing.T, sub *smiletest.Subscriber, repo *smiletest.Repository, args smile.WorkerArgs) func() error {
+	t.Helper()
+	svc, err := smile.NewService(sub, repo, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runService(t, svc, sub)
+}
+
+func runService(t *testing.T, svc *smile.Service, sub *smiletest.Subscriber) func() error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- svc.Run(ctx) }()
+	<-sub.Subscribed()
+	return func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after the context was canceled")
+			return nil
+		}
+	}
+}
+
+func TestRunOrdersWorkPerRequest(t *testing.T) {
+	sub := smiletest.NewSubscriber()
+	// adds are slow, so that anything not waiting for them overtakes them
+	repo := &smiletest.Repository{Hook: func(ctx context.Context, c smiletest.Call) error {
+		if c.Op == smiletest.OpAddRequest {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	}}
+	stop := startService(t, sub, repo, smile.WorkerArgs{})
+
+	requests := []string{"22022_A", "22022_B", "22022_C"}
+	for _, id := range requests {
+		r := smile.Request{IgoRequestID: id}
+		s := smile.Sample{PrimaryID: id + "_1", AdditionalProperties: smile.AdditionalProperties{IgoRequestID: id}}
+		sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{r}}
+		sub.UpdatedRequests <- smile.RequestAdaptor{Requests: []smile.Request{r, r}}
+		sub.UpdatedSamples <- smile.SampleAdaptor{Samples: []smile.Sample{s}}
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.Acked() != 3*len(requests) {
+		t.Errorf("acked %d messages, want %d", sub.Acked(), 3*len(requests))
+	}
+	calls := repo.Calls()
+	for _, id := range requests {
+		var got []string
+		for _, c := range calls {
+			if c.ID == id || c.ID == id+"_1" {
+				got = append(got, c.String())
+			}
+		}
+		want := fmt.Sprintf("[add %[1]s update %[1]s sample %[1]s_1]", id)
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: operations ran in order %v, want %s", id, got, want)
+		}
+	}
+	for _, msgType := range []string{smile.MsgAddRequest, smile.MsgUpdateRequest, smile.MsgUpdateSample} {
+		if n := testutil.ToFloat64(smile.MessagesQueued.WithLabelValues(msgType)); n != 0 {
+			t.Errorf("%s: %v messages still queued", msgType, n)
+		}
+		if n := testutil.ToFloat64(smile.MessagesInFlight.WithLabelValues(msgType)); n != 0 {
+			t.Errorf("%s: %v messages still in flight", msgType, n)
+		}
+	}
+	// unrelated requests are processed concurrently rather than one after the other
+	if repo.MaxConcurrent() < 2 {
+		t.Errorf("operations ran one at a time, want concurrent operations")
+	}
+}
+
+func TestRunSettlesMessages(t *testing.T) {
+	permanent := errors.New("syntax error")
+	transient := &smiletest.TransientError{Err: errors.New("dremio unavailable")}
+	tests := []struct {
+		name          string
+		repoErr       error
+		deadLetterErr error
+		wantAcked     int
+		wantNaked     int
+		wantDead      int
+		want          smile.MessageStats
+	}{
+		{"success", nil, nil, 1, 0, 0, smile.MessageStats{Received: 1, Acked: 1}},
+		// the message is acked once it has been dead lettered so it is not redelivered
+		{"permanent error", permanent, nil, 1, 0, 1, smile.MessageStats{Received: 1, DeadLettered: 1}},
+		{"transient error", transient, nil, 0, 1, 0, smile.MessageStats{Received: 1, Naked: 1}},
+		{"dead letter fails", permanent, errors.New("no responders"), 0, 1, 0, smile.MessageStats{Received: 1, Naked: 1}},
+	}
+	send := map[string]func(*smiletest.Subscriber){
+		smile.MsgAddRequest: func(sub *smiletest.Subscriber) {
+			sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{{IgoRequestID: "22022_BZ"}}}
+		},
+		smile.MsgUpdateRequest: func(sub *smiletest.Subscriber) {
+			r := smile.Request{IgoRequestID: "22022_BZ"}
+			sub.UpdatedRequests <- smile.RequestAdaptor{Requests: []smile.Request{r, r}}
+		},
+		smile.MsgUpdateSample: func(sub *smiletest.Subscriber) {
+			sub.UpdatedSamples <- smile.SampleAdaptor{Samples: []smile.Sample{{PrimaryID: "22022_BZ_1"}}}
+		},
+	}
+	for _, tt := range tests {
+		for msgType, fn := range send {
+			t.Run(tt.name+"/"+msgType, func(t *testing.T) {
+				sub := smiletest.NewSubscriber()
+				sub.DeadLetterErr = tt.deadLetterErr
+				repo := &smiletest.Repository{Hook: func(ctx context.Context, c smiletest.Call) error { return tt.repoErr }}
+				svc, err := smile.NewService(sub, repo, smile.WorkerArgs{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				stop := runService(t, svc, sub)
+				fn(sub)
+				if err := stop(); err != nil {
+					t.Fatal(err)
+				}
+
+				if sub.Acked() != tt.wantAcked || sub.Naked() != tt.wantNaked || len(sub.DeadLettered()) != tt.wantDead {
+					t.Errorf("acked %d, NAKed %d and dead lettered %d messages, want %d, %d and %d",
+						sub.Acked(), sub.Naked(), len(sub.DeadLettered()), tt.wantAcked, tt.wantNaked, tt.wantDead)
+				}
+				if tt.wantDead > 0 && sub.DeadLettered()[0] != tt.repoErr {
+					t.Errorf("dead lettered with %v, want %v", sub.DeadLettered()[0], tt.repoErr)
+				}
+				got := svc.Status()[msgType]
+				if (got.LastErrorTime != nil) != (tt.repoErr != nil) {
+					t.Errorf("last error time = %v, want it set on failure only", got.LastErrorTime)
+				}
+				got.LastError, got.LastErrorTime = "", nil
+				if got != tt.want {
+					t.Errorf("stats = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestRunShutdownNaksUnfinished(t *testing.T) {
+	sub := smiletest.NewSubscriber()
+	// updates to slow never finish on their own
+	repo := &smiletest.Repository{Hook: func(ctx context.Context, c smiletest.Call) error {
+		if c.ID == "slow" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}}
+	svc, err := smile.NewService(sub, repo, smile.WorkerArgs{ShutdownGracePeriod: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runService(t, svc, sub)
+
+	slow := smile.Request{IgoRequestID: "slow"}
+	// the add finishes within the grace period, the first slow update is cut off by it
+	// and the second one never starts
+	sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{{IgoRequestID: "22022_A"}}}
+	sub.UpdatedRequests <- smile.RequestAdaptor{Requests: []smile.Request{slow, slow}}
+	sub.UpdatedRequests <- smile.RequestAdaptor{Requests: []smile.Request{slow, slow}}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.Acked() != 1 || sub.Naked() != 2 {
+		t.Errorf("acked %d and NAKed %d messages, want 1 and 2", sub.Acked(), sub.Naked())
+	}
+	if len(sub.DeadLettered()) != 0 {
+		t.Errorf("dead lettered %v, abandoned messages must not be dead lettered", sub.DeadLettered())
+	}
+	status := svc.Status()
+	if got := status[smile.MsgUpdateRequest].Abandoned; got != 2 {
+		t.Errorf("abandoned %d update requests, want 2", got)
+	}
+	if got := status[smile.MsgAddRequest].Acked; got != 1 {
+		t.Errorf("acked %d add requests, want 1", got)
+	}
+	if status[smile.MsgUpdateRequest].LastError == "" || status[smile.MsgUpdateRequest].LastErrorTime == nil {
+		t.Error("last error of the update requests was not recorded")
+	}
+	if !sub.Stopped() || !sub.ShutDown() || !repo.Closed() {
+		t.Errorf("stopped %t, shut down %t, closed repository %t, want all of them",
+			sub.Stopped(), sub.ShutDown(), repo.Closed())
+	}
+}
+
+func TestRunShutdownWithWorkersFull(t *testing.T) {
+	sub := smiletest.NewSubscriber()
+	// nothing finishes on its own, as with dremio hanging
+	repo := &smiletest.Repository{Hook: func(ctx context.Context, c smiletest.Call) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	svc, err := smile.NewService(sub, repo, smile.WorkerArgs{AddRequestWorkers: 1, AddRequestQueueSize: 1, ShutdownGracePeriod: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := runService(t, svc, sub)
+
+	// the first request takes the worker, the second the queue and the third waits for room
+	for _, id := range []string{"22022_A", "22022_B", "22022_C"} {
+		sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{{IgoRequestID: id}}}
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.Acked() != 0 || sub.Naked() != 3 {
+		t.Errorf("acked %d and NAKed %d messages, want 0 and 3", sub.Acked(), sub.Naked())
+	}
+	if got := svc.Status()[smile.MsgAddRequest].Abandoned; got != 3 {
+		t.Errorf("abandoned %d add requests, want 3", got)
+	}
+	if !sub.Stopped() || !sub.ShutDown() || !repo.Closed() {
+		t.Errorf("stopped %t, shut down %t, closed repository %t, want all of them",
+			sub.Stopped(), sub.ShutDown(), repo.Closed())
+	}
+}
+
+func TestRunLimitsWorkersPerMessageType(t *testing.T) {
+	sub := smiletest.NewSubscriber()
+	release := make(chan struct{})
+	// updates hang until released, as with a slow dremio
+	repo := &smiletest.Repository{Hook: func(ctx context.Context, c smiletest.Call) error {
+		if c.Op == smiletest.OpUpdateRequest {
+			<-release
+		}
+		return nil
+	}}
+	stop := startService(t, sub, repo, smile.WorkerArgs{UpdateRequestWorkers: 1, UpdateRequestQueueSize: 1})
+
+	// the updates use up the worker and queue of their type
+	for _, id := range []string{"22022_A", "22022_B"} {
+		r := smile.Request{IgoRequestID: id}
+		sub.UpdatedRequests <- smile.RequestAdaptor{Requests: []smile.Request{r, r}}
+	}
+	// an add still gets a worker of its own
+	sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{{IgoRequestID: "22022_C"}}}
+	deadline := time.Now().Add(5 * time.Second)
+	for sub.Acked() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := sub.Acked(); n != 1 {
+		t.Errorf("acked %d messages while the updates were stuck, want the add to be acked", n)
+	}
+	close(release)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Acked() != 3 {
+		t.Errorf("acked %d messages, want 3", sub.Acked())
+	}
+}
+
+func TestRunSubscribeError(t *testing.T) {
+	sub := smiletest.NewSubscriber()
+	sub.SubscribeErr = errors.New("no stream")
+	svc, err := smile.NewService(sub, &smiletest.Repository{}, smile.WorkerArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Run(context.Background()); err != sub.SubscribeErr {
+		t.Fatalf("Run returned %v, want %v", err, sub.SubscribeErr)
+	}
+}
+
+var (
+	recorderOnce sync.Once
+	recorder     *tracetest.SpanRecorder
+)
+
+// spanRecorder installs a global tracer provider recording all spans. the package's tracer
+// only binds to the first provider installed, so it is done once for all tests.
+func spanRecorder() *tracetest.SpanRecorder {
+	recorderOnce.Do(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return recorder
+}
+
+func TestRunContinuesTraceFromHeaders(t *testing.T) {
+	sr := spanRecorder()
+	before := len(sr.Ended())
+
+	sub := smiletest.NewSubscriber()
+	stop := startService(t, sub, &smiletest.Repository{}, smile.WorkerArgs{})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	pm := nats.NewMsg("MDB_STREAM.server-new-request")
+	pm.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	msg := &nm.Msg{Subject: pm.Subject, ProviderMsg: pm}
+	sub.NewRequests <- smile.RequestAdaptor{Requests: []smile.Request{{IgoRequestID: "22022_BZ"}}, Msg: msg}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := sr.Ended()[before:]
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "smile."+smile.MsgAddRequest {
+		t.Errorf("span name = %s", span.Name())
+	}
+	if got := span.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace id = %s, want %s from the message headers", got, traceID)
+	}
+	attrs := make(map[attribute.Key]string)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs[smile.AttrOutcome] != smile.OutcomeAck || attrs[logging.IgoRequestID] != "22022_BZ" {
+		t.Errorf("unexpected span attributes %v", attrs)
+	}
+}
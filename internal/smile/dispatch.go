@@ -0,0 +1,108 @@
+package smile
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds how many tasks of one kind run at once and how many more may be waiting to run
+type limiter struct {
+	workers chan struct{}
+	slots   chan struct{}
+}
+
+func newLimiter(workers, queueSize int) *limiter {
+	return &limiter{
+		workers: make(chan struct{}, workers),
+		slots:   make(chan struct{}, workers+queueSize),
+	}
+}
+
+type task struct {
+	lim *limiter
+	fn  func()
+}
+
+// run executes the task once one of its limiter's workers is free
+func (t task) run() {
+	t.lim.workers <- struct{}{}
+	t.fn()
+	<-t.lim.workers
+	<-t.lim.slots
+}
+
+// keyedDispatcher runs tasks with the same key one after the other in the order they were
+// dispatched, while tasks with different keys run concurrently
+type keyedDispatcher struct {
+	mu sync.Mutex
+	// pending tasks per key, a key is present while a goroutine is working through its tasks
+	queues map[string][]task
+	wg     sync.WaitGroup
+}
+
+func newKeyedDispatcher() *keyedDispatcher {
+	return &keyedDispatcher{queues: make(map[string][]task)}
+}
+
+// Dispatch queues fn behind all previously dispatched tasks with the same key. it blocks
+// while lim has no room for another task, and gives up returning false once ctx is done.
+func (d *keyedDispatcher) Dispatch(ctx context.Context, key string, lim *limiter, fn func()) bool {
+	// a free slot is taken even if ctx is done, select would pick between the two at random
+	select {
+	case lim.slots <- struct{}{}:
+	default:
+		select {
+		case lim.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	d.wg.Add(1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := task{lim, fn}
+	if q, busy := d.queues[key]; busy {
+		d.queues[key] = append(q, t)
+		return true
+	}
+	d.queues[key] = nil
+	go d.run(key, t)
+	return true
+}
+
+// run executes t and then the tasks queued for key until there are none left
+func (d *keyedDispatcher) run(key string, t task) {
+	for {
+		t.run()
+		d.mu.Lock()
+		q := d.queues[key]
+		if len(q) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			d.wg.Done()
+			return
+		}
+		t, d.queues[key] = q[0], q[1:]
+		d.mu.Unlock()
+		d.wg.Done()
+	}
+}
+
+// Wait blocks until all dispatched tasks have completed
+func (d *keyedDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// requestKey orders all work on an igo request, including updates to its samples
+func requestKey(r Request) string {
+	return "request:" + r.IgoRequestID
+}
+
+// sampleKey orders sample updates behind the work on the request they belong to, samples
+// without a request are ordered on their own
+func sampleKey(s Sample) string {
+	if s.AdditionalProperties.IgoRequestID != "" {
+		return "request:" + s.AdditionalProperties.IgoRequestID
+	}
+	return "sample:" + s.PrimaryID
+}
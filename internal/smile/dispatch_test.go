@@ -0,0 +1,130 @@
+package smile
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherSerializesPerKey(t *testing.T) {
+	d := newKeyedDispatcher()
+	lim := newLimiter(3, 60)
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	running := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			i, key := i, key
+			d.Dispatch(context.Background(), key, lim, func() {
+				mu.Lock()
+				if running[key] {
+					t.Errorf("two tasks for %s running at once", key)
+				}
+				running[key] = true
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running[key] = false
+				got[key] = append(got[key], i)
+				mu.Unlock()
+			})
+		}
+	}
+	d.Wait()
+	for key, order := range got {
+		if len(order) != 20 {
+			t.Fatalf("%s: ran %d tasks, want 20", key, len(order))
+		}
+		for i, n := range order {
+			if n != i {
+				t.Fatalf("%s: tasks ran in order %v", key, order)
+			}
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.queues) != 0 {
+		t.Errorf("%d keys left behind", len(d.queues))
+	}
+}
+
+func TestDispatcherRunsKeysConcurrently(t *testing.T) {
+	d := newKeyedDispatcher()
+	lim := newLimiter(2, 0)
+	release := make(chan struct{})
+	done := make(chan struct{})
+	// a blocks until b has run, which deadlocks if keys share a worker
+	d.Dispatch(context.Background(), "a", lim, func() { <-release })
+	d.Dispatch(context.Background(), "b", lim, func() { close(release) })
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tasks with different keys did not run concurrently")
+	}
+}
+
+func TestDispatcherLimitsWorkers(t *testing.T) {
+	d := newKeyedDispatcher()
+	lim := newLimiter(2, 1)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	blocked := func() {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	// two tasks run and one waits for a worker, the fourth has no room
+	for _, key := range []string{"a", "b", "c"} {
+		d.Dispatch(context.Background(), key, lim, blocked)
+	}
+	dispatched := make(chan struct{})
+	go func() {
+		d.Dispatch(context.Background(), "d", lim, blocked)
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("Dispatch did not block on a saturated limiter")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-dispatched
+	d.Wait()
+	if maxRunning != 2 {
+		t.Errorf("%d tasks ran at once, want 2", maxRunning)
+	}
+}
+
+func TestDispatcherGivesUpOnCancel(t *testing.T) {
+	d := newKeyedDispatcher()
+	lim := newLimiter(1, 0)
+	release := make(chan struct{})
+	d.Dispatch(context.Background(), "a", lim, func() { <-release })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- d.Dispatch(ctx, "b", lim, func() { t.Error("task ran after Dispatch gave up") }) }()
+	cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Dispatch returned true on a canceled context")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch blocked after the context was canceled")
+	}
+	close(release)
+	d.Wait()
+}
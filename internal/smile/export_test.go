@@ -0,0 +1,10 @@
+package smile
+
+// unexported metrics and span attributes checked by the tests in package smile_test
+var (
+	MessagesQueued   = messagesQueued
+	MessagesInFlight = messagesInFlight
+	AttrOutcome      = attrOutcome
+)
+
+const OutcomeAck = outcomeAck
@@ -0,0 +1,42 @@
+package smile
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// values of the reason label of messagesFailed
+const (
+	reasonNak        = "nak"
+	reasonDeadLetter = "dead_letter"
+	// rejected while dead lettering is disabled
+	reasonDiscarded = "discarded"
+)
+
+var (
+	messagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dremio_gateway",
+		Name:      "messages_received_total",
+		Help:      "Messages received per filter subject.",
+	}, []string{"subject"})
+	messagesAcked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dremio_gateway",
+		Name:      "messages_acked_total",
+		Help:      "Messages persisted and acked per filter subject.",
+	}, []string{"subject"})
+	messagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dremio_gateway",
+		Name:      "messages_failed_total",
+		Help:      "Messages that could not be persisted per filter subject, by whether they were NAKed, dead lettered or discarded.",
+	}, []string{"subject", "reason"})
+	messagesQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dremio_gateway",
+		Name:      "messages_queued",
+		Help:      "Messages waiting for a worker per message type.",
+	}, []string{"type"})
+	messagesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "dremio_gateway",
+		Name:      "messages_in_flight",
+		Help:      "Messages being processed per message type.",
+	}, []string{"type"})
+)
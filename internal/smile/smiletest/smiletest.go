@@ -0,0 +1,236 @@
+// Package smiletest provides fakes of the smile.SmileSubscriber and smile.Repository
+// interfaces for testing smile.Service without nats or dremio.
+package smiletest
+
+import (
+	"context"
+	"github.com/mskcc/smile-dremio-gateway/internal/smile"
+	"sync"
+	"time"
+)
+
+// Subscriber hands the channels passed to SubscribeSmileConsumer to the test, which sends
+// messages on them, and records how every message was settled
+type Subscriber struct {
+	// set by SubscribeSmileConsumer, wait for Subscribed before using them
+	NewRequests     chan smile.RequestAdaptor
+	UpdatedRequests chan smile.RequestAdaptor
+	UpdatedSamples  chan smile.SampleAdaptor
+	// returned by SubscribeSmileConsumer
+	SubscribeErr error
+	// returned by DeadLetterRequest and DeadLetterSample, the message is not recorded as dead lettered
+	DeadLetterErr error
+
+	subscribed chan struct{}
+
+	mu           sync.Mutex
+	acked        int
+	naked        int
+	deadLettered []error
+	stopped      bool
+	shutdown     bool
+}
+
+func NewSubscriber() *Subscriber {
+	return &Subscriber{subscribed: make(chan struct{})}
+}
+
+// Subscribed is closed once SubscribeSmileConsumer succeeded
+func (s *Subscriber) Subscribed() <-chan struct{} {
+	return s.subscribed
+}
+
+func (s *Subscriber) SubscribeSmileConsumer(newRequestCh chan smile.RequestAdaptor, upRequestCh chan smile.RequestAdaptor, upSampleCh chan smile.SampleAdaptor) error {
+	if s.SubscribeErr != nil {
+		return s.SubscribeErr
+	}
+	s.NewRequests, s.UpdatedRequests, s.UpdatedSamples = newRequestCh, upRequestCh, upSampleCh
+	close(s.subscribed)
+	return nil
+}
+
+func (s *Subscriber) AckRequest(ra smile.RequestAdaptor) { s.settle(func() { s.acked++ }) }
+func (s *Subscriber) AckSample(sa smile.SampleAdaptor)   { s.settle(func() { s.acked++ }) }
+func (s *Subscriber) NakRequest(ra smile.RequestAdaptor) { s.settle(func() { s.naked++ }) }
+func (s *Subscriber) NakSample(sa smile.SampleAdaptor)   { s.settle(func() { s.naked++ }) }
+
+func (s *Subscriber) DeadLetterRequest(ra smile.RequestAdaptor, err error) error {
+	return s.deadLetter(err)
+}
+
+func (s *Subscriber) DeadLetterSample(sa smile.SampleAdaptor, err error) error {
+	return s.deadLetter(err)
+}
+
+func (s *Subscriber) deadLetter(err error) error {
+	if s.DeadLetterErr != nil {
+		return s.DeadLetterErr
+	}
+	s.settle(func() {
+		s.deadLettered = append(s.deadLettered, err)
+		s.acked++
+	})
+	return nil
+}
+
+func (s *Subscriber) Stop()     { s.settle(func() { s.stopped = true }) }
+func (s *Subscriber) Shutdown() { s.settle(func() { s.shutdown = true }) }
+
+func (s *Subscriber) settle(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+}
+
+// Acked returns the number of acked messages, dead lettered messages are acked too
+func (s *Subscriber) Acked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.acked
+}
+
+// Naked returns the number of NAKed messages
+func (s *Subscriber) Naked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.naked
+}
+
+// DeadLettered returns the errors messages were dead lettered with, in order
+func (s *Subscriber) DeadLettered() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.deadLettered...)
+}
+
+// Stopped reports whether Stop was called
+func (s *Subscriber) Stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// ShutDown reports whether Shutdown was called
+func (s *Subscriber) ShutDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+// repository operations recorded by Repository
+const (
+	OpAddRequest    = "add"
+	OpUpdateRequest = "update"
+	OpUpdateSample  = "sample"
+)
+
+// Call is an operation Repository was asked to perform
+type Call struct {
+	// one of OpAddRequest, OpUpdateRequest or OpUpdateSample
+	Op string
+	// igo request id of the (newest) request, or primary id of the newest sample
+	ID  string
+	Err error
+}
+
+// String returns op and id, e.g. "add 22022_BZ"
+func (c Call) String() string {
+	return c.Op + " " + c.ID
+}
+
+// Repository records the operations it performs, in the order they complete
+type Repository struct {
+	// how long every operation takes, cut short when its context is done
+	Delay time.Duration
+	// called with every operation once Delay has passed, a non-nil error fails the operation.
+	// it may block, for example on ctx, to simulate slow statements.
+	Hook func(ctx context.Context, c Call) error
+	// returned by Close
+	CloseErr error
+
+	mu         sync.Mutex
+	calls      []Call
+	running    int
+	maxRunning int
+	closed     bool
+}
+
+func (r *Repository) AddRequest(ctx context.Context, req smile.Request) error {
+	return r.do(ctx, Call{Op: OpAddRequest, ID: req.IgoRequestID})
+}
+
+func (r *Repository) UpdateRequest(ctx context.Context, reqs []smile.Request) error {
+	return r.do(ctx, Call{Op: OpUpdateRequest, ID: reqs[0].IgoRequestID})
+}
+
+func (r *Repository) UpdateSample(ctx context.Context, s []smile.Sample) error {
+	return r.do(ctx, Call{Op: OpUpdateSample, ID: s[0].PrimaryID})
+}
+
+func (r *Repository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return r.CloseErr
+}
+
+func (r *Repository) do(ctx context.Context, c Call) error {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.maxRunning {
+		r.maxRunning = r.running
+	}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.running--
+		r.calls = append(r.calls, c)
+	}()
+
+	if r.Delay > 0 {
+		t := time.NewTimer(r.Delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			c.Err = ctx.Err()
+			return c.Err
+		}
+	}
+	if r.Hook != nil {
+		c.Err = r.Hook(ctx, c)
+	}
+	return c.Err
+}
+
+// Calls returns the operations performed so far, in the order they completed
+func (r *Repository) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// MaxConcurrent returns the largest number of operations that ran at the same time
+func (r *Repository) MaxConcurrent() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.maxRunning
+}
+
+// Closed reports whether Close was called
+func (r *Repository) Closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// TransientError marks Err as transient, the way the dremio repository does for failures
+// that may succeed when retried
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string   { return e.Err.Error() }
+func (e *TransientError) Unwrap() error   { return e.Err }
+func (e *TransientError) Transient() bool { return true }
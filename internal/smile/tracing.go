@@ -0,0 +1,75 @@
+package smile
+
+import (
+	"context"
+	nm "github.com/mskcc/nats-messaging-go"
+	"github.com/mskcc/smile-dremio-gateway/internal/logging"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"strings"
+)
+
+var tracer = otel.Tracer("github.com/mskcc/smile-dremio-gateway/internal/smile")
+
+// what happened to a message, recorded on its span
+var attrOutcome = attribute.Key("smile.outcome")
+
+const (
+	outcomeAck        = "ack"
+	outcomeNak        = "nak"
+	outcomeDeadLetter = "dead_letter"
+	outcomeAbandoned  = "abandoned"
+)
+
+// startMessageSpan starts the span covering the processing of a message of msgType, continuing
+// the trace propagated in the headers of m if there is one. the returned context carries the
+// span and logger, which has the trace id added.
+func startMessageSpan(ctx context.Context, msgType string, m *nm.Msg, logger *slog.Logger, attrs ...attribute.KeyValue) (context.Context, *slog.Logger) {
+	attrs = append(attrs, semconv.MessagingSystem("nats"), semconv.MessagingOperationProcess)
+	if m != nil {
+		attrs = append(attrs, semconv.MessagingDestinationName(m.Subject))
+		if m.ProviderMsg != nil {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(m.ProviderMsg.Header))
+		}
+	}
+	ctx, span := tracer.Start(ctx, "smile."+msgType, trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(attrs...))
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logging.WithLogger(ctx, logger), logger
+}
+
+// headerCarrier reads trace context from nats headers. nats keeps header keys as published, so
+// unlike propagation.HeaderCarrier keys are matched case insensitively.
+type headerCarrier nats.Header
+
+func (h headerCarrier) Get(key string) string {
+	if v, ok := h[key]; ok && len(v) > 0 {
+		return v[0]
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = []string{value}
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+var _ propagation.TextMapCarrier = headerCarrier{}
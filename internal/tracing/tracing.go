@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"io"
+	"strings"
+)
+
+const defaultServiceName = "smile-dremio-gateway"
+
+// supported values of TracingArgs.Exporter
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+type TracingArgs struct {
+	// ExporterNone, ExporterStdout or ExporterOTLP, defaults to ExporterNone
+	Exporter string
+	// host:port of the otlp grpc collector, when empty the OTEL_EXPORTER_OTLP_* variables apply
+	Endpoint string
+	// connect to the collector without tls
+	Insecure bool
+	// fraction of traces started by the gateway that are sampled, 0 samples everything
+	SampleRatio float64
+	// defaults to defaultServiceName
+	ServiceName string
+	// where ExporterStdout writes spans, defaults to stdout
+	Writer io.Writer
+}
+
+// Setup installs a global tracer provider exporting as configured by args and the w3c trace
+// context propagator used by nats-messaging-go. the returned func flushes and stops the exporter.
+func Setup(ctx context.Context, args TracingArgs) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if args.SampleRatio < 0 || args.SampleRatio > 1 {
+		return nil, errors.New("sample ratio must be between 0 and 1")
+	}
+	var exp sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(args.Exporter) {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		opts := []stdouttrace.Option{stdouttrace.WithPrettyPrint()}
+		if args.Writer != nil {
+			opts = append(opts, stdouttrace.WithWriter(args.Writer))
+		}
+		exp, err = stdouttrace.New(opts...)
+	case ExporterOTLP:
+		var opts []otlptracegrpc.Option
+		if args.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(args.Endpoint))
+		}
+		if args.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exp, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("invalid exporter %q, must be one of none, stdout or otlp", args.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if args.ServiceName == "" {
+		args.ServiceName = defaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if args.SampleRatio > 0 {
+		sampler = sdktrace.TraceIDRatioBased(args.SampleRatio)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		// continue the sampling decision of traces started upstream of the gateway
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(args.ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"go.opentelemetry.io/otel"
+	"strings"
+	"testing"
+)
+
+func TestSetupErrors(t *testing.T) {
+	for _, args := range []TracingArgs{
+		{Exporter: "jaeger"},
+		{Exporter: ExporterStdout, SampleRatio: 1.5},
+		{Exporter: ExporterStdout, SampleRatio: -0.1},
+	} {
+		if _, err := Setup(context.Background(), args); err == nil {
+			t.Errorf("Setup(%+v) expected error", args)
+		}
+	}
+}
+
+func TestSetupNone(t *testing.T) {
+	shutdown, err := Setup(context.Background(), TracingArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupStdout(t *testing.T) {
+	var buf bytes.Buffer
+	shutdown, err := Setup(context.Background(), TracingArgs{Exporter: ExporterStdout, ServiceName: "test-gateway", Writer: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "smile.addRequest")
+	span.End()
+	// shutting down flushes the batched span
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"smile.addRequest", "test-gateway"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("exported spans do not contain %q: %s", want, buf.String())
+		}
+	}
+}